@@ -0,0 +1,165 @@
+package main
+
+import (
+	"calc-service/internal/agentpb"
+	"calc-service/internal/operations"
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcOrchestrator работает через gRPC-поток: задачи приходят от оркестратора
+// сами, а результаты и продления аренды отправляются в тот же поток
+type grpcOrchestrator struct {
+	stream agentpb.AgentService_ConnectClient
+	// Send у потока нельзя вызывать из нескольких горутин одновременно
+	sendMutex sync.Mutex
+}
+
+func (o *grpcOrchestrator) send(msg *agentpb.AgentMessage) error {
+	o.sendMutex.Lock()
+	defer o.sendMutex.Unlock()
+	return o.stream.Send(msg)
+}
+
+func (o *grpcOrchestrator) renewLease(task *Task) error {
+	return o.send(&agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Heartbeat{
+		Heartbeat: &agentpb.Heartbeat{Id: task.ID, Redispatches: int32(task.Redispatches)},
+	}})
+}
+
+func (o *grpcOrchestrator) report(taskID string, result float64, errMsg string) error {
+	return o.send(&agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Result{
+		Result: &agentpb.TaskResult{Id: taskID, Result: result, Error: errMsg},
+	}})
+}
+
+// release сообщает, что задача брошена без результата, и освобождает слот
+func (o *grpcOrchestrator) release(taskID string) error {
+	return o.send(&agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Release{
+		Release: &agentpb.Release{Id: taskID},
+	}})
+}
+
+// drain сообщает, что агент завершает работу и новые задачи ему не нужны
+func (o *grpcOrchestrator) drain() error {
+	return o.send(&agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Drain{
+		Drain: &agentpb.Drain{},
+	}})
+}
+
+// runGRPC получает задачи через gRPC-поток и переподключается при его обрыве,
+// пока не отменён ctx
+func runGRPC(ctx context.Context, addr string, capacity int) {
+	for {
+		err := serveStream(ctx, addr, capacity)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("gRPC stream closed: %v", err)
+		}
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveStream открывает поток, сообщает оркестратору число слотов и
+// выполняет присылаемые задачи, пока поток не закроется. Когда отменён ctx,
+// агент отправляет drain и дожидается, пока оркестратор закроет поток после
+// получения результатов всех выданных задач.
+func serveStream(ctx context.Context, addr string, capacity int) error {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Поток не привязан к ctx: после сигнала по нему ещё отправляются результаты
+	streamCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := agentpb.NewAgentServiceClient(conn).Connect(streamCtx)
+	if err != nil {
+		return err
+	}
+	o := &grpcOrchestrator{stream: stream}
+
+	err = o.send(&agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Hello{
+		Hello: helloMessage(capacity),
+	}})
+	if err != nil {
+		return err
+	}
+	log.Printf("Connected to orchestrator at %s", addr)
+
+	pool := newWorkerPool(capacity, func(task *Task) {
+		if err := execute(o, task); err != nil {
+			log.Printf("Task %s failed: %v", task.ID, err)
+			if err := o.release(task.ID); err != nil {
+				log.Printf("Failed to release task %s: %v", task.ID, err)
+			}
+		}
+	})
+	defer pool.stop()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := o.drain(); err != nil {
+				log.Printf("Failed to send drain: %v", err)
+			}
+		case <-streamCtx.Done():
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF && ctx.Err() != nil {
+			// Оркестратор получил все результаты и закрыл поток
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Task == nil {
+			continue
+		}
+
+		// Оркестратор присылает не больше задач, чем у агента слотов,
+		// поэтому свободный воркер всегда найдётся
+		pool.reserve(streamCtx, 1)
+		pool.submit(fromProtoTask(msg.Task))
+	}
+}
+
+// helloMessage регистрирует агента в начале потока
+func helloMessage(capacity int) *agentpb.Hello {
+	hostname, _ := os.Hostname()
+	return &agentpb.Hello{
+		Capacity:  int32(capacity),
+		Hostname:  hostname,
+		Operators: operations.Operators,
+		Version:   version,
+	}
+}
+
+func fromProtoTask(t *agentpb.Task) *Task {
+	return &Task{
+		ID:            t.Id,
+		ExpressionID:  t.ExpressionId,
+		Args:          t.Args,
+		Operator:      t.Operation,
+		OperationTime: int(t.OperationTime),
+		Redispatches:  int(t.Redispatches),
+		Lease:         time.Duration(t.LeaseMs) * time.Millisecond,
+	}
+}
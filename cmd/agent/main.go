@@ -1,238 +1,389 @@
 package main
 
 import (
+	"calc-service/internal/operations"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
 type Task struct {
-	ID            string  `json:"id"`
-	ExpressionID  string  `json:"expression_id"`
-	Arg1          string  `json:"arg1"`
-	Arg2          string  `json:"arg2"`
-	Operator      string  `json:"operation"`
-	OperationTime int     `json:"operation_time"`
-	Result        float64 `json:"result,omitempty"`
+	ID            string   `json:"id"`
+	ExpressionID  string   `json:"expression_id"`
+	Args          []string `json:"args"`
+	Operator      string   `json:"operation"`
+	OperationTime int      `json:"operation_time"`
+	Result        float64  `json:"result,omitempty"`
+	Redispatches  int      `json:"redispatches"`
+	// Lease — время, в течение которого задачу нужно завершить или продлить
+	Lease time.Duration `json:"-"`
 }
 
-type TaskResponse struct {
-	Task *Task `json:"task"`
+type TaskBatchResponse struct {
+	Tasks   []*Task `json:"tasks"`
+	LeaseMs int64   `json:"lease_ms"`
 }
 
-const (
-	maxRetries     = 5
-	baseRetryDelay = 2 * time.Second
-)
-
 func main() {
-	orchestratorHost := os.Getenv("ORCHESTRATOR_HOST")
-	if orchestratorHost == "" {
-		orchestratorHost = "localhost"
+	baseURL, err := orchestratorURL()
+	if err != nil {
+		log.Fatalf("Invalid orchestrator address: %v", err)
 	}
 
 	computingPower := getEnvAsInt("COMPUTING_POWER", 10)
-	maxWorkers = computingPower
-	log.Printf("Starting agent with %d workers", computingPower)
 
-	for i := 0; i < computingPower; i++ {
-		go worker(i+1, orchestratorHost)
+	// По SIGTERM или SIGINT агент перестаёт брать задачи, доделывает начатые,
+	// отправляет их результаты и завершается. Повторный сигнал завершает его сразу.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Printf("Shutting down: finishing tasks in progress")
+	}()
+
+	// AGENT_TRANSPORT выбирает протокол обмена с оркестратором: http (по умолчанию) или grpc
+	switch transport := os.Getenv("AGENT_TRANSPORT"); transport {
+	case "", "http":
+		log.Printf("Starting agent with %d workers", computingPower)
+		runHTTP(ctx, baseURL.String(), computingPower)
+	case "grpc":
+		addr := os.Getenv("ORCHESTRATOR_GRPC_ADDR")
+		if addr == "" {
+			addr = baseURL.Hostname() + ":9090"
+		}
+		log.Printf("Starting gRPC agent with capacity %d", computingPower)
+		runGRPC(ctx, addr, computingPower)
+	default:
+		log.Fatalf("Unknown AGENT_TRANSPORT: %s", transport)
 	}
-	select {}
+	log.Printf("Agent stopped")
 }
 
-func worker(workerID int, orchestratorHost string) {
-	for {
-		task, ok := fetchTask(orchestratorHost)
-		if !ok {
-			time.Sleep(1 * time.Second)
-			continue
-		}
+// orchestrator — транспорт, через который агент общается с оркестратором
+type orchestrator interface {
+	// renewLease продлевает аренду выполняемой задачи
+	renewLease(task *Task) error
+	// report сообщает результат задачи; непустой errMsg — ошибка вычисления
+	report(taskID string, result float64, errMsg string) error
+}
 
-		log.Printf("Worker %d: Processing task %s (%s %s %s)",
-			workerID, task.ID, task.Arg1, task.Operator, task.Arg2)
+// httpOrchestrator работает через внутреннее HTTP API оркестратора
+type httpOrchestrator struct {
+	baseURL string
+	results *resultBatcher
+}
 
-		result, err := processTask(task)
-		if err != nil {
-			log.Printf("Worker %d: Task %s failed: %v", workerID, task.ID, err)
-			// Уменьшаем счетчик при ошибке обработки
-			taskMutex.Lock()
-			activeWorkers--
-			taskMutex.Unlock()
-			continue
+func (o httpOrchestrator) renewLease(task *Task) error {
+	return sendHeartbeat(o.baseURL, task)
+}
+
+func (o httpOrchestrator) report(taskID string, result float64, errMsg string) error {
+	return o.results.submit(taskResult{ID: taskID, Result: result, Error: errMsg})
+}
+
+// orchestratorURL возвращает базовый адрес оркестратора из ORCHESTRATOR_URL:
+// схему, хост, порт и путь, например https://calc.example.com/calc.
+// Если переменная не задана, используется http://ORCHESTRATOR_HOST:8080.
+func orchestratorURL() (*url.URL, error) {
+	raw := os.Getenv("ORCHESTRATOR_URL")
+	if raw == "" {
+		host := os.Getenv("ORCHESTRATOR_HOST")
+		if host == "" {
+			host = "localhost"
 		}
+		raw = "http://" + host + ":8080"
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme in %q", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %q", raw)
+	}
+	// Пути запросов дописываются к базовому через "/"
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery, u.Fragment = "", ""
+	return u, nil
+}
+
+// execute выполняет задачу, продлевая её аренду, и сообщает результат.
+// Ошибка вычисления (например, деление на ноль) тоже сообщается оркестратору;
+// возвращаются только ошибки, из-за которых результата нет.
+func execute(o orchestrator, task *Task) error {
+	log.Printf("Processing task %s %s(%s)", task.ID, task.Operator, strings.Join(task.Args, ", "))
 
-		if err := sendResult(orchestratorHost, task.ID, result); err != nil {
-			log.Printf("Worker %d: Failed to send result: %v", workerID, err)
-		} else {
-			log.Printf("Worker %d: Task %s result %.2f sent", workerID, task.ID, result)
+	// Пока задача выполняется, продлеваем её аренду у оркестратора
+	done := make(chan struct{})
+	go keepLease(o, task, done)
+	result, err := processTask(task)
+	close(done)
+
+	var calcErr *calculationError
+	if errors.As(err, &calcErr) {
+		// Выражение завершится со статусом error
+		log.Printf("Task %s failed: %v", task.ID, calcErr)
+		if err := o.report(task.ID, 0, calcErr.Error()); err != nil {
+			return fmt.Errorf("failed to send error: %w", err)
 		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		// Уменьшаем счетчик после успешной обработки
-		taskMutex.Lock()
-		activeWorkers--
-		taskMutex.Unlock()
+	if err := o.report(task.ID, result, ""); err != nil {
+		return fmt.Errorf("failed to send result: %w", err)
 	}
+	log.Printf("Task %s result %.2f sent", task.ID, result)
+	return nil
 }
 
-var (
-	taskMutex     sync.Mutex
-	activeWorkers int
-	maxWorkers    int
-)
+// runHTTP работает через внутреннее HTTP API, пока не отменён ctx, а затем
+// дожидается, пока воркеры выполнят полученные задачи и отправят результаты
+func runHTTP(ctx context.Context, baseURL string, computingPower int) {
+	reg := &registration{}
+	interval, err := reg.mustRegister(ctx, baseURL, computingPower)
+	if err != nil {
+		return
+	}
+	// Heartbeat агента продолжается, пока доделываются начатые задачи
+	regCtx, stopHeartbeats := context.WithCancel(context.Background())
+	defer stopHeartbeats()
+	go reg.keepRegistered(regCtx, baseURL, computingPower, interval)
+
+	results := &resultBatcher{baseURL: baseURL, queue: make(chan pendingResult, computingPower)}
+	go results.run()
+	o := httpOrchestrator{baseURL: baseURL, results: results}
+
+	pool := newWorkerPool(computingPower, func(task *Task) {
+		if err := execute(o, task); err != nil {
+			log.Printf("Task %s failed: %v", task.ID, err)
+		}
+	})
+	fetcher(ctx, baseURL, reg, pool)
+	// submit ждёт отправки результата, поэтому после stop все результаты уже у оркестратора
+	pool.stop()
+}
 
-func fetchTask(orchestratorHost string) (*Task, bool) {
-	taskMutex.Lock()
-	defer taskMutex.Unlock()
+// fetcher запрашивает сразу столько задач, сколько в пуле свободных воркеров,
+// и передаёт их воркерам. Возвращается, когда отменён ctx.
+func fetcher(ctx context.Context, baseURL string, reg *registration, pool *workerPool) {
+	for {
+		free := pool.reserve(ctx, cap(pool.tasks))
+		if free == 0 {
+			return
+		}
+		tasks, err := fetchTasks(ctx, baseURL, reg.ID(), free)
+		pool.release(free - len(tasks))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to fetch tasks: %v", err)
+			select {
+			case <-time.After(1 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
 
-	// Проверяем количество активных воркеров
-	if activeWorkers >= maxWorkers {
-		return nil, false
+		for _, task := range tasks {
+			pool.submit(task)
+		}
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+// taskWait — сколько оркестратор держит запрос задач, если готовых задач нет
+const taskWait = 30 * time.Second
+
+// fetchTasks запрашивает до limit задач с ожиданием taskWait. Если за это
+// время задач не появилось, возвращает пустой список без ошибки.
+func fetchTasks(ctx context.Context, baseURL, agentID string, limit int) ([]*Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, taskWait+10*time.Second)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s:8080/internal/task", orchestratorHost)
+	url := fmt.Sprintf("%s/internal/task?wait=%s&limit=%d&agent_id=%s", baseURL, taskWait, limit, agentID)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		return nil, false
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("Network error: %v", err)
-		return nil, false
+		return nil, fmt.Errorf("network error: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, false
+		return nil, nil
 	}
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Server error: %d", resp.StatusCode)
-		return nil, false
+		return nil, fmt.Errorf("server error: %d", resp.StatusCode)
 	}
 
-	var response TaskResponse
+	var response TaskBatchResponse
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		log.Printf("Decoding error: %v", err)
-		return nil, false
+		return nil, fmt.Errorf("decoding error: %w", err)
+	}
+	for _, task := range response.Tasks {
+		task.Lease = time.Duration(response.LeaseMs) * time.Millisecond
 	}
-	activeWorkers++
-	return response.Task, response.Task != nil
+	return response.Tasks, nil
 }
 
-func processTask(task *Task) (float64, error) {
-	orchestratorHost := os.Getenv("ORCHESTRATOR_HOST")
-	if orchestratorHost == "" {
-		orchestratorHost = "orchestrator"
+// keepLease продлевает аренду задачи каждую треть её срока, пока не закрыт done
+func keepLease(o orchestrator, task *Task, done <-chan struct{}) {
+	if task.Lease <= 0 {
+		return
 	}
+	ticker := time.NewTicker(task.Lease / 3)
+	defer ticker.Stop()
 
-	arg1, err := resolveArgument(orchestratorHost, task.Arg1)
-	if err != nil {
-		return 0, fmt.Errorf("argument 1: %w", err)
-	}
-	arg2, err := resolveArgument(orchestratorHost, task.Arg2)
-	if err != nil {
-		return 0, fmt.Errorf("argument 2: %w", err)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := o.renewLease(task); err != nil {
+				log.Printf("Task %s: heartbeat failed: %v", task.ID, err)
+			}
+		}
 	}
-	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
-	return calculate(task.Operator, arg1, arg2)
 }
 
-func resolveArgument(orchestratorHost, arg string) (float64, error) {
-	if strings.HasPrefix(arg, "task:") {
-		taskID := strings.TrimPrefix(arg, "task:")
-		return fetchTaskResultWithRetry(orchestratorHost, taskID)
+func sendHeartbeat(baseURL string, task *Task) error {
+	jsonData, err := json.Marshal(struct {
+		ID           string `json:"id"`
+		Redispatches int    `json:"redispatches"`
+	}{
+		ID:           task.ID,
+		Redispatches: task.Redispatches,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
 	}
-	return strconv.ParseFloat(arg, 64)
-}
 
-func fetchTaskResult(orchestratorHost, taskID string) (float64, error) {
+	url := baseURL + "/internal/task/heartbeat"
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-
-	url := fmt.Sprintf("http://%s:8080/api/v1/tasks/%s", orchestratorHost, taskID)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonData)))
 	if err != nil {
-		return 0, fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("network error: %w", err)
+		return fmt.Errorf("post error: %w", err)
 	}
 	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return 0, fmt.Errorf("failed to read response: %w", err)
-	}
-	log.Printf("Task %s result response: %s", taskID, string(body))
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("status code %d: %s", resp.StatusCode, string(body))
-	}
-	var result struct {
-		Result float64 `json:"result"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return 0, fmt.Errorf("decoding error: %w, body: %s", err, string(body))
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
 	}
-	return result.Result, nil
+	return nil
 }
 
-func fetchTaskResultWithRetry(orchestratorHost, taskID string) (float64, error) {
-	for i := 0; i < maxRetries; i++ {
-		result, err := fetchTaskResult(orchestratorHost, taskID)
-		if err == nil {
-			return result, nil
+// processTask выполняет операцию. Оркестратор выдаёт задачу, когда все её
+// аргументы уже вычислены, поэтому они приходят числами.
+func processTask(task *Task) (float64, error) {
+	args := make([]float64, len(task.Args))
+	for i, arg := range task.Args {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, fmt.Errorf("argument %d: %w", i+1, err)
 		}
-		delay := time.Duration(i+1) * baseRetryDelay
-		log.Printf("Retry %d/%d for task %s (delay: %v)", i+1, maxRetries, taskID, delay)
-		time.Sleep(delay)
+		args[i] = value
+	}
+	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+	result, err := operations.Apply(task.Operator, args)
+	if err != nil {
+		return 0, &calculationError{err: err}
 	}
-	return 0, fmt.Errorf("max retries exceeded for task %s", taskID)
+	return result, nil
+}
+
+// calculationError — ошибка самой операции (например, деление на ноль),
+// в отличие от сетевых ошибок её бессмысленно повторять
+type calculationError struct {
+	err error
+}
+
+func (e *calculationError) Error() string { return e.err.Error() }
+
+func (e *calculationError) Unwrap() error { return e.err }
+
+type taskResult struct {
+	ID     string  `json:"id"`
+	Result float64 `json:"result"`
+	// Error — ошибка вычисления; выражение завершится со статусом error
+	Error string `json:"error,omitempty"`
+}
+
+type pendingResult struct {
+	result taskResult
+	done   chan error
 }
 
-func calculate(operator string, a, b float64) (float64, error) {
-	switch operator {
-	case "+":
-		return a + b, nil
-	case "-":
-		return a - b, nil
-	case "*":
-		return a * b, nil
-	case "/":
-		if b == 0 {
-			return 0, fmt.Errorf("division by zero")
+// resultBatcher отправляет результаты воркеров пачками: пока идёт один
+// запрос, новые результаты копятся и уходят следующим запросом
+type resultBatcher struct {
+	baseURL string
+	queue   chan pendingResult
+}
+
+// submit ставит результат в очередь и ждёт, пока пачка с ним будет отправлена
+func (b *resultBatcher) submit(result taskResult) error {
+	done := make(chan error, 1)
+	b.queue <- pendingResult{result: result, done: done}
+	return <-done
+}
+
+func (b *resultBatcher) run() {
+	for first := range b.queue {
+		batch := []pendingResult{first}
+		for more := true; more; {
+			select {
+			case next := <-b.queue:
+				batch = append(batch, next)
+			default:
+				more = false
+			}
+		}
+
+		results := make([]taskResult, len(batch))
+		for i, pending := range batch {
+			results[i] = pending.result
+		}
+		err := sendResults(b.baseURL, results)
+		for _, pending := range batch {
+			pending.done <- err
 		}
-		return a / b, nil
-	default:
-		return 0, fmt.Errorf("unknown operator: %s", operator)
 	}
 }
 
-func sendResult(orchestratorHost string, taskID string, result float64) error {
-	payload := struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result"`
-	}{
-		ID:     taskID,
-		Result: result,
-	}
-	jsonData, err := json.Marshal(payload)
+// sendResults отправляет результаты нескольких задач одним запросом
+func sendResults(baseURL string, results []taskResult) error {
+	jsonData, err := json.Marshal(results)
 	if err != nil {
 		return fmt.Errorf("marshal error: %w", err)
 	}
 
-	url := fmt.Sprintf("http://%s:8080/internal/task", orchestratorHost)
+	url := baseURL + "/internal/task"
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonData)))
@@ -240,20 +391,19 @@ func sendResult(orchestratorHost string, taskID string, result float64) error {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("POST error: %v", err)
 		return fmt.Errorf("post error: %w", err)
 	}
 	defer resp.Body.Close()
-	log.Printf("Response status: %d", resp.StatusCode)
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
 	}
+	log.Printf("Sent %d results", len(results))
 	return nil
 }
+
 func getEnvAsInt(key string, defaultValue int) int {
 	val := os.Getenv(key)
 	if val == "" {
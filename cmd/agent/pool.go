@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// workerPool — фиксированное число воркеров, которые берут задачи из
+// ограниченного канала. Перед отправкой задачи в канал нужно занять
+// свободного воркера через reserve, поэтому submit никогда не блокируется.
+type workerPool struct {
+	tasks chan *Task
+	// Токен в idle — воркер, который может взять задачу прямо сейчас
+	idle chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newWorkerPool запускает size воркеров, каждый из которых выполняет задачи через handle
+func newWorkerPool(size int, handle func(task *Task)) *workerPool {
+	p := &workerPool{
+		tasks: make(chan *Task, size),
+		idle:  make(chan struct{}, size),
+	}
+	for i := 0; i < size; i++ {
+		p.idle <- struct{}{}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				handle(task)
+				p.idle <- struct{}{}
+			}
+		}()
+	}
+	return p
+}
+
+// reserve ждёт, пока освободится хотя бы один воркер, и занимает до max
+// свободных. Возвращает 0, если ctx отменён раньше.
+func (p *workerPool) reserve(ctx context.Context, max int) int {
+	select {
+	case <-p.idle:
+	case <-ctx.Done():
+		return 0
+	}
+	n := 1
+	for n < max {
+		select {
+		case <-p.idle:
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// release возвращает n занятых, но не получивших задачу воркеров
+func (p *workerPool) release(n int) {
+	for i := 0; i < n; i++ {
+		p.idle <- struct{}{}
+	}
+}
+
+// submit передаёт задачу занятому через reserve воркеру
+func (p *workerPool) submit(task *Task) {
+	p.tasks <- task
+}
+
+// stop закрывает канал задач и ждёт, пока воркеры закончат начатые
+func (p *workerPool) stop() {
+	close(p.tasks)
+	p.wg.Wait()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"calc-service/internal/operations"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// version — версия агента, задаётся при сборке: -ldflags "-X main.version=1.2.0"
+var version = "dev"
+
+// errUnknownAgent — оркестратор не знает агента (например, он перезапустился)
+var errUnknownAgent = errors.New("agent is not registered")
+
+// registration хранит ID, выданный агенту оркестратором. При повторной
+// регистрации ID меняется, поэтому воркеры читают его перед каждым запросом.
+type registration struct {
+	mutex sync.Mutex
+	id    string
+}
+
+func (r *registration) ID() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.id
+}
+
+// agentInfo описывает агента при регистрации
+func agentInfo(computingPower int) map[string]any {
+	hostname, _ := os.Hostname()
+	return map[string]any{
+		"hostname":        hostname,
+		"computing_power": computingPower,
+		"operators":       operations.Operators,
+		"version":         version,
+	}
+}
+
+// register регистрирует агента и возвращает интервал отправки heartbeat
+func (r *registration) register(baseURL string, computingPower int) (time.Duration, error) {
+	jsonData, err := json.Marshal(agentInfo(computingPower))
+	if err != nil {
+		return 0, fmt.Errorf("marshal error: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/internal/agents", bytes.NewReader(jsonData))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("post error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response struct {
+		ID          string `json:"id"`
+		HeartbeatMs int64  `json:"heartbeat_ms"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, fmt.Errorf("decoding error: %w", err)
+	}
+
+	r.mutex.Lock()
+	r.id = response.ID
+	r.mutex.Unlock()
+	log.Printf("Registered as %s", response.ID)
+	return time.Duration(response.HeartbeatMs) * time.Millisecond, nil
+}
+
+// mustRegister повторяет регистрацию, пока оркестратор не ответит или не будет отменён ctx
+func (r *registration) mustRegister(ctx context.Context, baseURL string, computingPower int) (time.Duration, error) {
+	for {
+		interval, err := r.register(baseURL, computingPower)
+		if err == nil && interval > 0 {
+			return interval, nil
+		}
+		log.Printf("Registration failed: %v", err)
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// keepRegistered отправляет heartbeat каждые interval и регистрирует агента
+// заново, если оркестратор его не знает. Останавливается, когда отменён ctx.
+func (r *registration) keepRegistered(ctx context.Context, baseURL string, computingPower int, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		err := sendAgentHeartbeat(baseURL, r.ID())
+		if errors.Is(err, errUnknownAgent) {
+			if interval, err = r.mustRegister(ctx, baseURL, computingPower); err != nil {
+				return
+			}
+		} else if err != nil {
+			log.Printf("Agent heartbeat failed: %v", err)
+		}
+	}
+}
+
+func sendAgentHeartbeat(baseURL, agentID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/internal/agents/%s/heartbeat", baseURL, agentID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errUnknownAgent
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -1,26 +1,42 @@
 package main
 
 import (
+	"calc-service/internal/agentpb"
 	"calc-service/internal/handler"
+	"calc-service/internal/store"
 	"calc-service/pkg/logger"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
 	// Initialize logger
 	initLogger()
 
+	// Open storage and reload expressions left from the previous run
+	st, err := initStorage()
+	if err != nil {
+		log.Fatalf("Storage initialization failed: %v", err)
+	}
+	h := handler.New(st)
+
 	// API for user
-	http.HandleFunc("/api/v1/calculate", handler.HandleCalculate)
-	http.HandleFunc("/api/v1/expressions", handler.HandleExpressions)
-	http.HandleFunc("/api/v1/expressions/", handler.HandleExpressionByID)
+	http.HandleFunc("/api/v1/calculate", h.HandleCalculate)
+	http.HandleFunc("/api/v1/expressions", h.HandleExpressions)
+	http.HandleFunc("/api/v1/expressions/", h.HandleExpressionByID)
+	http.HandleFunc("/api/v1/agents", h.HandleAgents)
 
 	// Internal API for agents
-	http.HandleFunc("/internal/task", handler.TaskHandler)
-	http.HandleFunc("/api/v1/tasks/", handler.HandleTaskByID)
+	http.HandleFunc("/internal/task", h.TaskHandler)
+	http.HandleFunc("/internal/task/heartbeat", h.HandleTaskHeartbeat)
+	http.HandleFunc("/internal/agents", h.HandleRegisterAgent)
+	http.HandleFunc("/internal/agents/", h.HandleAgentHeartbeat)
+	http.HandleFunc("/api/v1/tasks/", h.HandleTaskByID)
 
 	// Frontend
 	http.Handle("/", http.FileServer(http.Dir("./static")))
@@ -31,8 +47,12 @@ func main() {
 		port = "8080"
 	}
 
-	// Start background task to update task readiness periodically
-	go updateTasksReadinessPeriodically()
+	// Hand out again tasks whose agents stopped renewing the lease
+	// and time out expressions past their deadline
+	go expireDeadlinesPeriodically(st)
+
+	// gRPC API for agents, served alongside the HTTP one
+	go serveGRPC(st)
 
 	logger.Info("Server starting on http://localhost:%s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
@@ -57,16 +77,48 @@ func initLogger() {
 	logger.Init(logLevel)
 }
 
-func updateTasksReadinessPeriodically() {
-	// Periodically check task readiness
-	ticker := time.NewTicker(500 * time.Millisecond)
+// Create the store with the backend selected by STORAGE_BACKEND ("memory" or "bolt")
+func initStorage() (*store.Store, error) {
+	path := os.Getenv("STORAGE_PATH")
+	if path == "" {
+		path = "calc.db"
+	}
+
+	backend, err := store.NewBackend(os.Getenv("STORAGE_BACKEND"), path)
+	if err != nil {
+		return nil, err
+	}
+	return store.Open(backend)
+}
+
+// Serve the gRPC agent service on GRPC_PORT (default 9090)
+func serveGRPC(st *store.Store) {
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		port = "9090"
+	}
+
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("gRPC listen failed: %v", err)
+	}
+	server := grpc.NewServer()
+	agentpb.RegisterAgentServiceServer(server, handler.NewAgentServer(st))
+
+	logger.Info("gRPC server starting on :%s", port)
+	log.Fatal(server.Serve(lis))
+}
+
+func expireDeadlinesPeriodically(st *store.Store) {
+	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	for {
-		select {
-		case <-ticker.C:
-			// Update task readiness for all expressions
-			handler.UpdateAllTasksReadiness()
+	for now := range ticker.C {
+		for _, task := range st.ReclaimExpiredTasks(now) {
+			logger.Info("Task %s lease expired, re-dispatching (attempt %d)", task.ID, task.Redispatches+1)
+		}
+		for _, id := range st.ExpireExpressions(now) {
+			logger.Info("Expression %s timed out", id)
 		}
 	}
 }
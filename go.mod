@@ -3,3 +3,16 @@ module calc-service
 go 1.21
 
 require github.com/joho/godotenv v1.5.1
+
+require (
+	go.etcd.io/bbolt v1.3.10
+	google.golang.org/grpc v1.64.1
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
+)
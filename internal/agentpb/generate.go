@@ -0,0 +1,5 @@
+// Package agentpb contains the gRPC service used between agents and the
+// orchestrator, generated from proto/agent.proto.
+package agentpb
+
+//go:generate protoc -I ../../proto --go_out=../.. --go_opt=module=calc-service --go-grpc_out=../.. --go-grpc_opt=module=calc-service agent.proto
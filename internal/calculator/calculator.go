@@ -2,26 +2,36 @@ package calculator
 
 import (
 	"calc-service/internal/store"
-	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Глобальные переменные и генерация ID задачи
 var taskCounter uint64
 
-func generateTaskID() string {
-	id := atomic.AddUint64(&taskCounter, 1)
-	return "task-" + strconv.FormatUint(id, 10)
+func generateTaskID(st *store.Store) string {
+	for {
+		id := "task-" + strconv.FormatUint(atomic.AddUint64(&taskCounter, 1), 10)
+		// После перезапуска счётчик начинается заново, а задачи прошлых
+		// запусков загружены из хранилища: их ID пропускаем
+		if _, exists := st.GetTask(id); !exists {
+			return id
+		}
+	}
 }
 
 // Лексический анализ: токенизация
 type token struct {
 	value string
 	type_ tokenType
+	pos   int    // смещение токена в символах от начала выражения
+	text  string // исходная запись токена
 }
 
 type tokenType int
@@ -29,175 +39,492 @@ type tokenType int
 const (
 	number tokenType = iota
 	operator
+	unaryOperator
+	function
+	variable
+	comma
 	leftParen
 	rightParen
 )
 
+// expectsOperand сообщает, стоит ли токенизатор в позиции, где ожидается
+// операнд: в начале выражения, после оператора, запятой или открывающей скобки.
+// Знак в такой позиции является унарным.
+func expectsOperand(tokens []token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	switch tokens[len(tokens)-1].type_ {
+	case operator, unaryOperator, comma, leftParen:
+		return true
+	default:
+		return false
+	}
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isLetter(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_'
+}
+
+// scanNumber возвращает конец числового литерала, начинающегося с позиции start,
+// и признак его корректности. Литерал — цифры с не более чем одной точкой
+// и необязательной экспонентой: 12, .5, 3.14, 1e-3, 6.02E23.
+func scanNumber(expression string, start int) (int, bool) {
+	end := start
+	digits, dots := 0, 0
+	for end < len(expression) && (isDigit(expression[end]) || expression[end] == '.') {
+		if expression[end] == '.' {
+			dots++
+		} else {
+			digits++
+		}
+		end++
+	}
+	valid := digits > 0 && dots <= 1
+	if end < len(expression) && (expression[end] == 'e' || expression[end] == 'E') {
+		end++
+		if end < len(expression) && (expression[end] == '+' || expression[end] == '-') {
+			end++
+		}
+		if end >= len(expression) || !isDigit(expression[end]) {
+			return end, false
+		}
+		for end < len(expression) && isDigit(expression[end]) {
+			end++
+		}
+	}
+	return end, valid
+}
+
 func tokenize(expression string) ([]token, error) {
 	var tokens []token
-	var current strings.Builder
-	parenCount := 0
+	// Позиции открытых скобок для сообщения о несбалансированной скобке
+	var openParens []int
+	// Число лишних байт многобайтовых символов, уже пройденных сканером:
+	// позиция в символах равна i - extraBytes
+	extraBytes := 0
 
-	for i, ch := range expression {
+	for i := 0; i < len(expression); i++ {
+		ch := expression[i]
+		pos := i - extraBytes
 		switch {
-		case unicode.IsDigit(ch) || ch == '.':
-			current.WriteRune(ch)
-			if i == len(expression)-1 || !(unicode.IsDigit(rune(expression[i+1])) || expression[i+1] == '.') {
-				tokens = append(tokens, token{current.String(), number})
-				current.Reset()
+		case isDigit(ch) || ch == '.':
+			end, valid := scanNumber(expression, i)
+			text := expression[i:end]
+			if !valid {
+				return nil, newParseError(ErrCodeInvalidNumber, pos, text, "invalid number")
 			}
-		case ch == '+' || ch == '-' || ch == '*' || ch == '/':
-			if current.Len() > 0 {
-				tokens = append(tokens, token{current.String(), number})
-				current.Reset()
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, newParseError(ErrCodeInvalidNumber, pos, text, "number out of range")
+			}
+			tokens = append(tokens, token{text, number, pos, text})
+			i = end - 1
+		case isLetter(ch):
+			start := i
+			for i+1 < len(expression) && (isLetter(expression[i+1]) || isDigit(expression[i+1])) {
+				i++
+			}
+			name := expression[start : i+1]
+			// Между именем функции и скобкой допустимы пробелы: sqrt (16)
+			isCall := strings.HasPrefix(strings.TrimLeftFunc(expression[i+1:], unicode.IsSpace), "(")
+			switch {
+			case isCall && !isFunction(name):
+				return nil, newParseError(ErrCodeUnknownFunction, pos, name, "unknown function")
+			case isCall:
+				tokens = append(tokens, token{name, function, pos, name})
+			case isFunction(name):
+				return nil, newParseError(ErrCodeUnexpectedToken, pos, name, "function requires arguments")
+			default:
+				tokens = append(tokens, token{name, variable, pos, name})
+			}
+		case ch == '+' || ch == '-' || ch == '*' || ch == '/' || ch == '^':
+			if (ch == '+' || ch == '-') && expectsOperand(tokens) {
+				// Унарный плюс ничего не меняет и задачи не порождает
+				if ch == '-' {
+					tokens = append(tokens, token{"neg", unaryOperator, pos, "-"})
+				}
+				continue
 			}
-			tokens = append(tokens, token{string(ch), operator})
+			op, text := string(ch), string(ch)
+			// "**" — синоним возведения в степень
+			if ch == '*' && i+1 < len(expression) && expression[i+1] == '*' {
+				op, text = "^", "**"
+				i++
+			}
+			tokens = append(tokens, token{op, operator, pos, text})
+		case ch == ',':
+			tokens = append(tokens, token{",", comma, pos, ","})
 		case ch == '(':
-			tokens = append(tokens, token{"(", leftParen})
-			parenCount++
+			tokens = append(tokens, token{"(", leftParen, pos, "("})
+			openParens = append(openParens, pos)
 		case ch == ')':
-			if current.Len() > 0 {
-				tokens = append(tokens, token{current.String(), number})
-				current.Reset()
+			if len(openParens) == 0 {
+				return nil, newParseError(ErrCodeUnbalancedParentheses, pos, ")", "unbalanced parentheses")
 			}
-			tokens = append(tokens, token{")", rightParen})
-			parenCount--
-			if parenCount < 0 {
-				return nil, fmt.Errorf("unbalanced parentheses")
+			tokens = append(tokens, token{")", rightParen, pos, ")"})
+			openParens = openParens[:len(openParens)-1]
+		default:
+			r, size := utf8.DecodeRuneInString(expression[i:])
+			if !unicode.IsSpace(r) {
+				return nil, newParseError(ErrCodeInvalidSymbol, pos, string(r), "invalid symbol in expression")
 			}
+			i += size - 1
+			extraBytes += size - 1
 		}
 	}
-	if parenCount != 0 {
-		return nil, fmt.Errorf("unbalanced parentheses")
+	if len(openParens) != 0 {
+		return nil, newParseError(ErrCodeUnbalancedParentheses, openParens[len(openParens)-1], "(", "unbalanced parentheses")
 	}
 	return tokens, nil
 }
 
+// insertImplicitMultiplication вставляет оператор "*" там, где множители записаны
+// подряд: между числом и "(", между ")" и "(", между ")" и числом
+func insertImplicitMultiplication(tokens []token) []token {
+	result := make([]token, 0, len(tokens))
+	for i, t := range tokens {
+		if i > 0 {
+			prev := tokens[i-1].type_
+			if prev == number && t.type_ == leftParen ||
+				prev == rightParen && (t.type_ == leftParen || t.type_ == number) {
+				result = append(result, token{"*", operator, t.pos, ""})
+			}
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
 // Синтаксический анализ: построение дерева выражения
 type Node struct {
 	Value    string
 	Left     *Node
 	Right    *Node
+	Args     []*Node // аргументы вызова функции
+	Variable bool    // лист является именем переменной, а не числом
+	Pos      int     // позиция узла в исходном выражении
 	TaskID   string
 	Priority int
 }
 
+// operands возвращает аргументы узла в порядке их передачи в задачу
+func (n *Node) operands() []*Node {
+	if n.Args != nil {
+		return n.Args
+	}
+	var result []*Node
+	if n.Left != nil {
+		result = append(result, n.Left)
+	}
+	if n.Right != nil {
+		result = append(result, n.Right)
+	}
+	return result
+}
+
+// String записывает поддерево в виде выражения с явной расстановкой скобок
+func (n *Node) String() string {
+	switch {
+	case n.Variable:
+		return n.Value
+	case n.Args != nil:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = arg.String()
+		}
+		return n.Value + "(" + strings.Join(args, ", ") + ")"
+	case isUnaryOperator(n.Value):
+		return "-" + n.Left.String()
+	case n.Left != nil && n.Right != nil:
+		return "(" + n.Left.String() + n.Value + n.Right.String() + ")"
+	default:
+		return n.Value
+	}
+}
+
+// Встроенные функции и допустимое число аргументов (maxArgs < 0 — без ограничения)
+var functions = map[string]struct{ minArgs, maxArgs int }{
+	"sqrt": {1, 1},
+	"abs":  {1, 1},
+	"log":  {1, 2},
+	"pow":  {2, 2},
+	"min":  {1, -1},
+	"max":  {1, -1},
+}
+
+func isFunction(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
 func precedence(op string) int {
 	switch op {
 	case "+", "-":
 		return 1
 	case "*", "/":
 		return 2
+	case "neg":
+		return 3
+	case "^":
+		return 4
 	default:
 		return 0
 	}
 }
 
+func isRightAssociative(op string) bool {
+	return op == "^"
+}
+
+func isUnaryOperator(op string) bool {
+	return op == "neg"
+}
+
+// applyOperator снимает со стека операндов аргументы оператора op
+// и кладёт обратно построенный узел.
+func applyOperator(outputQueue []*Node, op token) ([]*Node, error) {
+	if isUnaryOperator(op.value) {
+		if len(outputQueue) < 1 {
+			return nil, unexpectedToken(op)
+		}
+		operand := outputQueue[len(outputQueue)-1]
+		outputQueue = outputQueue[:len(outputQueue)-1]
+		return append(outputQueue, &Node{
+			Value:    op.value,
+			Left:     operand,
+			Pos:      op.pos,
+			Priority: precedence(op.value),
+		}), nil
+	}
+	if len(outputQueue) < 2 {
+		return nil, unexpectedToken(op)
+	}
+	right := outputQueue[len(outputQueue)-1]
+	left := outputQueue[len(outputQueue)-2]
+	outputQueue = outputQueue[:len(outputQueue)-2]
+	return append(outputQueue, &Node{
+		Value:    op.value,
+		Left:     left,
+		Right:    right,
+		Pos:      op.pos,
+		Priority: precedence(op.value),
+	}), nil
+}
+
+// applyFunction снимает со стека операндов argCount аргументов функции fn
+func applyFunction(outputQueue []*Node, fn token, argCount int) ([]*Node, error) {
+	arity := functions[fn.value]
+	if argCount < arity.minArgs || arity.maxArgs >= 0 && argCount > arity.maxArgs {
+		return nil, newParseError(ErrCodeWrongArgumentCount, fn.pos, fn.text,
+			"wrong number of arguments for %s: %d", fn.value, argCount)
+	}
+	if len(outputQueue) < argCount {
+		return nil, unexpectedToken(fn)
+	}
+	args := make([]*Node, argCount)
+	copy(args, outputQueue[len(outputQueue)-argCount:])
+	outputQueue = outputQueue[:len(outputQueue)-argCount]
+	return append(outputQueue, &Node{Value: fn.value, Args: args, Pos: fn.pos}), nil
+}
+
 func buildExpressionTree(tokens []token) (*Node, error) {
 	var outputQueue []*Node
-	var operatorStack []string
+	var operatorStack []token
+	// Число аргументов для каждого открытого вызова функции
+	var argCounts []int
+	// Грамматика проверяется по ходу разбора: в каждой точке выражения
+	// ожидается либо операнд, либо оператор
+	expectOperand := true
+	var err error
+
+	for i, t := range tokens {
+		if expectOperand {
+			switch t.type_ {
+			case number, variable, function, unaryOperator, leftParen:
+			case rightParen:
+				// Пустые скобки допустимы только у вызова функции без аргументов
+				if i == 0 || tokens[i-1].type_ != leftParen ||
+					len(operatorStack) < 2 || operatorStack[len(operatorStack)-2].type_ != function {
+					return nil, unexpectedToken(t)
+				}
+			default:
+				return nil, unexpectedToken(t)
+			}
+		} else {
+			switch t.type_ {
+			case operator, comma, rightParen:
+			default:
+				return nil, unexpectedToken(t)
+			}
+		}
 
-	for _, t := range tokens {
 		switch t.type_ {
 		case number:
-			outputQueue = append(outputQueue, &Node{Value: t.value})
+			outputQueue = append(outputQueue, &Node{Value: t.value, Pos: t.pos})
+			expectOperand = false
+		case variable:
+			outputQueue = append(outputQueue, &Node{Value: t.value, Variable: true, Pos: t.pos})
+			expectOperand = false
+		case unaryOperator:
+			// Префиксный оператор ещё не имеет операнда, поэтому ничего не выталкивает
+			operatorStack = append(operatorStack, t)
 		case operator:
+			// Правоассоциативный оператор не выталкивает оператор того же приоритета:
+			// 2^3^2 = 2^(3^2)
 			for len(operatorStack) > 0 &&
-				precedence(operatorStack[len(operatorStack)-1]) >= precedence(t.value) &&
-				operatorStack[len(operatorStack)-1] != "(" {
+				operatorStack[len(operatorStack)-1].type_ != leftParen &&
+				(precedence(operatorStack[len(operatorStack)-1].value) > precedence(t.value) ||
+					precedence(operatorStack[len(operatorStack)-1].value) == precedence(t.value) && !isRightAssociative(t.value)) {
 				op := operatorStack[len(operatorStack)-1]
 				operatorStack = operatorStack[:len(operatorStack)-1]
-				if len(outputQueue) < 2 {
-					return nil, fmt.Errorf("invalid expression")
+				if outputQueue, err = applyOperator(outputQueue, op); err != nil {
+					return nil, err
 				}
-				right := outputQueue[len(outputQueue)-1]
-				left := outputQueue[len(outputQueue)-2]
-				outputQueue = outputQueue[:len(outputQueue)-2]
-				outputQueue = append(outputQueue, &Node{
-					Value:    op,
-					Left:     left,
-					Right:    right,
-					Priority: precedence(op),
-				})
 			}
-			operatorStack = append(operatorStack, t.value)
+			operatorStack = append(operatorStack, t)
+			expectOperand = true
+		case function:
+			operatorStack = append(operatorStack, t)
 		case leftParen:
-			operatorStack = append(operatorStack, t.value)
+			if i > 0 && tokens[i-1].type_ == function {
+				argCounts = append(argCounts, 1)
+			}
+			operatorStack = append(operatorStack, t)
+		case comma:
+			for len(operatorStack) > 0 && operatorStack[len(operatorStack)-1].type_ != leftParen {
+				op := operatorStack[len(operatorStack)-1]
+				operatorStack = operatorStack[:len(operatorStack)-1]
+				if outputQueue, err = applyOperator(outputQueue, op); err != nil {
+					return nil, err
+				}
+			}
+			// Запятая допустима только внутри вызова функции
+			if len(operatorStack) < 2 || operatorStack[len(operatorStack)-2].type_ != function {
+				return nil, unexpectedToken(t)
+			}
+			argCounts[len(argCounts)-1]++
+			expectOperand = true
 		case rightParen:
-			for len(operatorStack) > 0 && operatorStack[len(operatorStack)-1] != "(" {
+			emptyCall := expectOperand
+			for len(operatorStack) > 0 && operatorStack[len(operatorStack)-1].type_ != leftParen {
 				op := operatorStack[len(operatorStack)-1]
 				operatorStack = operatorStack[:len(operatorStack)-1]
-				if len(outputQueue) < 2 {
-					return nil, fmt.Errorf("invalid expression")
+				if outputQueue, err = applyOperator(outputQueue, op); err != nil {
+					return nil, err
 				}
-				right := outputQueue[len(outputQueue)-1]
-				left := outputQueue[len(outputQueue)-2]
-				outputQueue = outputQueue[:len(outputQueue)-2]
-				outputQueue = append(outputQueue, &Node{
-					Value:    op,
-					Left:     left,
-					Right:    right,
-					Priority: precedence(op),
-				})
 			}
 			if len(operatorStack) == 0 {
-				return nil, fmt.Errorf("unbalanced parentheses")
+				return nil, newParseError(ErrCodeUnbalancedParentheses, t.pos, t.text, "unbalanced parentheses")
 			}
 			operatorStack = operatorStack[:len(operatorStack)-1]
+			if len(operatorStack) > 0 && operatorStack[len(operatorStack)-1].type_ == function {
+				fn := operatorStack[len(operatorStack)-1]
+				operatorStack = operatorStack[:len(operatorStack)-1]
+				argCount := argCounts[len(argCounts)-1]
+				argCounts = argCounts[:len(argCounts)-1]
+				if emptyCall {
+					argCount = 0
+				}
+				if outputQueue, err = applyFunction(outputQueue, fn, argCount); err != nil {
+					return nil, err
+				}
+			}
+			expectOperand = false
 		}
 	}
 
+	if len(tokens) == 0 {
+		return nil, newParseError(ErrCodeEmptyExpression, 0, "", "empty expression")
+	}
+	if expectOperand {
+		last := tokens[len(tokens)-1]
+		return nil, newParseError(ErrCodeUnexpectedEnd, last.pos+len(last.text), "", "unexpected end of expression")
+	}
+
 	for len(operatorStack) > 0 {
 		op := operatorStack[len(operatorStack)-1]
 		operatorStack = operatorStack[:len(operatorStack)-1]
-		if len(outputQueue) < 2 {
-			return nil, fmt.Errorf("invalid expression")
+		if op.type_ == leftParen {
+			return nil, newParseError(ErrCodeUnbalancedParentheses, op.pos, op.text, "unbalanced parentheses")
+		}
+		if outputQueue, err = applyOperator(outputQueue, op); err != nil {
+			return nil, err
 		}
-		right := outputQueue[len(outputQueue)-1]
-		left := outputQueue[len(outputQueue)-2]
-		outputQueue = outputQueue[:len(outputQueue)-2]
-		outputQueue = append(outputQueue, &Node{
-			Value:    op,
-			Left:     left,
-			Right:    right,
-			Priority: precedence(op),
-		})
 	}
 
 	if len(outputQueue) != 1 {
-		return nil, fmt.Errorf("invalid expression")
+		return nil, newParseError(ErrCodeUnexpectedToken, outputQueue[len(outputQueue)-1].Pos,
+			outputQueue[len(outputQueue)-1].Value, "unexpected token")
 	}
 	return outputQueue[0], nil
 }
 
 // Генерация задач на основе дерева выражения
 func isOperator(op string) bool {
-	return op == "+" || op == "-" || op == "*" || op == "/"
+	return op == "+" || op == "-" || op == "*" || op == "/" || op == "^" || isUnaryOperator(op)
+}
+
+// isTaskNode сообщает, вычисляется ли узел отдельной задачей
+func isTaskNode(n *Node) bool {
+	// Переменная может называться так же, как операция (например, neg)
+	if n.Variable {
+		return false
+	}
+	return isOperator(n.Value) || isFunction(n.Value)
 }
 
-func getNodeReference(n *Node) string {
+func getNodeReference(n *Node, variables map[string]float64) string {
 	if n == nil {
 		return ""
 	}
-	if isOperator(n.Value) {
+	if isTaskNode(n) {
 		return "task:" + n.TaskID
 	}
+	if n.Variable {
+		return strconv.FormatFloat(variables[n.Value], 'g', -1, 64)
+	}
 	return n.Value
 }
 
+// checkVariables проверяет, что для всех переменных дерева переданы значения
+func checkVariables(node *Node, variables map[string]float64) error {
+	if node.Variable {
+		if _, ok := variables[node.Value]; !ok {
+			return newParseError(ErrCodeUnboundVariable, node.Pos, node.Value, "unbound variable")
+		}
+		return nil
+	}
+	for _, operand := range node.operands() {
+		if err := checkVariables(operand, variables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func getOperationTime(op string) int {
 	var envVar string
 	switch op {
 	case "+":
 		envVar = os.Getenv("TIME_ADDITION_MS")
-	case "-":
+	case "-", "neg":
+		// Унарный минус — это вычитание из нуля
 		envVar = os.Getenv("TIME_SUBTRACTION_MS")
 	case "*":
 		envVar = os.Getenv("TIME_MULTIPLICATIONS_MS")
 	case "/":
 		envVar = os.Getenv("TIME_DIVISIONS_MS")
+	case "^":
+		envVar = os.Getenv("TIME_POWER_MS")
 	default:
-		return 0
+		if !isFunction(op) {
+			return 0
+		}
+		envVar = os.Getenv("TIME_FUNCTION_MS")
 	}
 	t, err := strconv.Atoi(envVar)
 	if err != nil {
@@ -206,28 +533,58 @@ func getOperationTime(op string) int {
 	return t
 }
 
-func createTasksFromTree(exprID string, node *Node) []*store.Task {
+// structuralKey возвращает ключ задачи узла по оператору и ссылкам на аргументы.
+// Аргументы-задачи к этому моменту уже дедуплицированы, поэтому одинаковые
+// поддеревья получают одинаковые ключи. Числа нормализуются ("1.0" и "1"),
+// а аргументы коммутативных операций сортируются ("a+b" и "b+a").
+func structuralKey(op string, args []string) string {
+	normalized := make([]string, len(args))
+	for i, arg := range args {
+		normalized[i] = arg
+		if value, err := strconv.ParseFloat(arg, 64); err == nil {
+			normalized[i] = strconv.FormatFloat(value, 'g', -1, 64)
+		}
+	}
+	if op == "+" || op == "*" {
+		sort.Strings(normalized)
+	}
+	return op + "(" + strings.Join(normalized, ",") + ")"
+}
+
+// createTasksFromTree создаёт задачи для узлов дерева. Одинаковые подвыражения
+// вычисляются одной задачей, на результат которой ссылаются все её потребители,
+// поэтому список задач образует DAG. Корневая задача всегда последняя в списке.
+func createTasksFromTree(st *store.Store, exprID string, node *Node, variables map[string]float64) []*store.Task {
+	return createTasks(st, exprID, node, variables, make(map[string]string))
+}
+
+func createTasks(st *store.Store, exprID string, node *Node, variables map[string]float64, seen map[string]string) []*store.Task {
 	var tasks []*store.Task
 	if node == nil {
 		return tasks
 	}
 	// Обход в пост-ордера
-	if node.Left != nil {
-		tasks = append(tasks, createTasksFromTree(exprID, node.Left)...)
-	}
-	if node.Right != nil {
-		tasks = append(tasks, createTasksFromTree(exprID, node.Right)...)
+	operands := node.operands()
+	for _, operand := range operands {
+		tasks = append(tasks, createTasks(st, exprID, operand, variables, seen)...)
 	}
-	if isOperator(node.Value) {
-		taskID := generateTaskID()
+	if isTaskNode(node) {
+		args := make([]string, len(operands))
+		for i, operand := range operands {
+			args[i] = getNodeReference(operand, variables)
+		}
+		key := structuralKey(node.Value, args)
+		if taskID, ok := seen[key]; ok {
+			node.TaskID = taskID
+			return tasks
+		}
+		taskID := generateTaskID(st)
 		node.TaskID = taskID
-		arg1 := getNodeReference(node.Left)
-		arg2 := getNodeReference(node.Right)
+		seen[key] = taskID
 		task := &store.Task{
 			ID:            taskID,
 			ExpressionID:  exprID,
-			Arg1:          arg1,
-			Arg2:          arg2,
+			Args:          args,
 			Operator:      node.Value,
 			OperationTime: getOperationTime(node.Value),
 			Ready:         false,
@@ -241,31 +598,66 @@ func createTasksFromTree(exprID string, node *Node) []*store.Task {
 
 // Валидация выражения и основной процессинг
 func ValidateExpression(expr string) error {
-	valid := "0123456789.+-*/() "
-	balance := 0
+	valid := "0123456789.+-*/^(), "
+	var openParens []int
+	var prev rune
+	inIdentifier := false
+	pos := 0
 	for _, ch := range expr {
-		if !strings.ContainsRune(valid, ch) && !unicode.IsSpace(ch) {
-			return fmt.Errorf("invalid symbol in expression")
+		switch {
+		case ch < unicode.MaxASCII && isLetter(byte(ch)):
+			// Имя не может начинаться сразу после числа: "2a".
+			// Исключение — экспонента числа в научной записи: "1e-3"
+			isExponent := ch == 'e' || ch == 'E'
+			if !inIdentifier && !isExponent && (unicode.IsDigit(prev) || prev == '.') {
+				return newParseError(ErrCodeInvalidSymbol, pos, string(ch), "invalid symbol in expression")
+			}
+			inIdentifier = true
+		case unicode.IsDigit(ch):
+		case !strings.ContainsRune(valid, ch) && !unicode.IsSpace(ch):
+			return newParseError(ErrCodeInvalidSymbol, pos, string(ch), "invalid symbol in expression")
+		default:
+			inIdentifier = false
 		}
+		prev = ch
 		if ch == '(' {
-			balance++
+			openParens = append(openParens, pos)
 		}
 		if ch == ')' {
-			balance--
-			if balance < 0 {
-				return fmt.Errorf("unbalanced parentheses")
+			if len(openParens) == 0 {
+				return newParseError(ErrCodeUnbalancedParentheses, pos, ")", "unbalanced parentheses")
 			}
+			openParens = openParens[:len(openParens)-1]
 		}
+		pos++
 	}
-	if balance != 0 {
-		return fmt.Errorf("unbalanced parentheses")
+	if len(openParens) != 0 {
+		return newParseError(ErrCodeUnbalancedParentheses, openParens[len(openParens)-1], "(", "unbalanced parentheses")
 	}
 	return nil
 }
 
-func ProcessExpression(exprStr string) (*store.Expression, error) {
-	// Очистка строки от пробелов
-	exprStr = strings.ReplaceAll(exprStr, " ", "")
+// Options задаёт параметры обработки отдельного выражения
+type Options struct {
+	// Variables — значения переменных, подставляемые при создании задач
+	Variables map[string]float64
+	// ImplicitMultiplication разрешает запись умножения без знака: 2(3+4), (1+2)(3+4)
+	ImplicitMultiplication bool
+	// Mode — режим вычисления: ModeDistributed (по умолчанию) или ModeFold
+	Mode string
+	// FoldThreshold — порог стоимости свёртки в мс для ModeFold; 0 — значение из FOLD_THRESHOLD_MS
+	FoldThreshold int
+	// PreserveOrder отключает перебалансировку цепочек + и *, сохраняя
+	// порядок вычислений (и округления) в точности как записано
+	PreserveOrder bool
+	// Timeout — время, за которое выражение должно быть вычислено, иначе оно
+	// получает статус timeout; 0 — значение из EXPRESSION_TIMEOUT_MS
+	Timeout time.Duration
+}
+
+// ProcessExpression разбирает выражение и регистрирует его задачи в хранилище st.
+// Ошибки разбора возвращаются как *ParseError с позицией относительно исходной строки.
+func ProcessExpression(st *store.Store, exprStr string, opts Options) (*store.Expression, error) {
 	if err := ValidateExpression(exprStr); err != nil {
 		return nil, err
 	}
@@ -273,13 +665,59 @@ func ProcessExpression(exprStr string) (*store.Expression, error) {
 	if err != nil {
 		return nil, err
 	}
+	if opts.ImplicitMultiplication {
+		tokens = insertImplicitMultiplication(tokens)
+	}
 	tree, err := buildExpressionTree(tokens)
 	if err != nil {
 		return nil, err
 	}
-	expr := store.NewExpression(exprStr)
-	tasks := createTasksFromTree(expr.ID, tree)
-	store.RegisterTasks(expr.ID, tasks)
-	store.UpdateTasksReadiness(expr.ID)
+	if err := checkVariables(tree, opts.Variables); err != nil {
+		return nil, err
+	}
+	if !opts.PreserveOrder {
+		tree = rebalance(tree)
+	}
+	var folded []store.FoldedNode
+	if opts.Mode == ModeFold {
+		threshold := opts.FoldThreshold
+		if threshold <= 0 {
+			threshold = getFoldThreshold()
+		}
+		tree, folded = foldConstants(tree, opts.Variables, threshold)
+	}
+	// Выражение хранится без пробелов
+	expr := st.NewExpression(strings.ReplaceAll(exprStr, " ", ""), opts.Variables)
+	tasks := createTasksFromTree(st, expr.ID, tree, opts.Variables)
+	if opts.Mode == ModeFold {
+		st.SetEvaluationPlan(expr.ID, opts.Mode, folded, distributedNodes(tree))
+	}
+	if len(tasks) == 0 {
+		// Выражению без операций (или целиком свёрнутому) задачи не нужны
+		value, err := evaluateTree(tree, opts.Variables)
+		if err != nil {
+			return nil, err
+		}
+		st.CompleteExpression(expr.ID, value)
+		return expr, nil
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = getExpressionTimeout()
+	}
+	if timeout > 0 {
+		st.SetDeadline(expr.ID, time.Now().Add(timeout))
+	}
+	st.RegisterTasks(expr.ID, tasks)
 	return expr, nil
 }
+
+// getExpressionTimeout возвращает ограничение времени вычисления выражения из
+// EXPRESSION_TIMEOUT_MS; 0 — без ограничения
+func getExpressionTimeout() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("EXPRESSION_TIMEOUT_MS"))
+	if err != nil || ms < 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
@@ -1,13 +1,20 @@
 package calculator
 
 import (
+	"calc-service/internal/store"
+	"errors"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGenerateTaskID(t *testing.T) {
-	id1 := generateTaskID()
-	id2 := generateTaskID()
+	st := store.New()
+	id1 := generateTaskID(st)
+	id2 := generateTaskID(st)
 	if id1 == id2 {
 		t.Errorf("expected different IDs, got same: %s", id1)
 	}
@@ -44,7 +51,7 @@ func TestProcessExpression_Valid(t *testing.T) {
 	os.Setenv("TIME_MULTIPLICATIONS_MS", "140")
 	os.Setenv("TIME_DIVISIONS_MS", "150")
 
-	expr, err := ProcessExpression("1+2")
+	expr, err := ProcessExpression(store.New(), "1+2", Options{})
 	if err != nil {
 		t.Errorf("expected no error, got: %v", err)
 	}
@@ -54,12 +61,42 @@ func TestProcessExpression_Valid(t *testing.T) {
 }
 
 func TestProcessExpression_Invalid(t *testing.T) {
-	_, err := ProcessExpression("1+2a")
+	_, err := ProcessExpression(store.New(), "1+2a", Options{})
 	if err == nil {
 		t.Error("expected error for invalid expression")
 	}
 }
 
+func TestProcessExpression_Timeout(t *testing.T) {
+	st := store.New()
+	expr, err := ProcessExpression(st, "1+2", Options{Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := st.GetExpression(expr.ID)
+	if left := time.Until(res.Deadline); left <= 0 || left > time.Minute {
+		t.Errorf("unexpected deadline: %v", res.Deadline)
+	}
+
+	// Без timeout_ms берётся EXPRESSION_TIMEOUT_MS, по умолчанию ограничения нет
+	t.Setenv("EXPRESSION_TIMEOUT_MS", "")
+	expr, err = ProcessExpression(st, "1+2", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := st.GetExpression(expr.ID); !res.Deadline.IsZero() {
+		t.Errorf("expected no deadline, got %v", res.Deadline)
+	}
+	t.Setenv("EXPRESSION_TIMEOUT_MS", "5000")
+	expr, err = ProcessExpression(st, "1+2", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := st.GetExpression(expr.ID); res.Deadline.IsZero() {
+		t.Error("expected the deadline from EXPRESSION_TIMEOUT_MS")
+	}
+}
+
 func TestGetOperationTime(t *testing.T) {
 	os.Setenv("TIME_ADDITION_MS", "200")
 	if opTime := getOperationTime("+"); opTime != 200 {
@@ -80,4 +117,408 @@ func TestGetOperationTime(t *testing.T) {
 	if opTime := getOperationTime("/"); opTime != 230 {
 		t.Errorf("expected 230, got %d", opTime)
 	}
+
+	os.Setenv("TIME_POWER_MS", "240")
+	if opTime := getOperationTime("^"); opTime != 240 {
+		t.Errorf("expected 240, got %d", opTime)
+	}
+}
+
+// evalTree вычисляет дерево выражения локально для проверки его структуры
+func evalTree(t *testing.T, n *Node) float64 {
+	t.Helper()
+	if n.Args != nil {
+		args := make([]float64, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = evalTree(t, arg)
+		}
+		switch n.Value {
+		case "sqrt":
+			return math.Sqrt(args[0])
+		case "abs":
+			return math.Abs(args[0])
+		case "pow":
+			return math.Pow(args[0], args[1])
+		case "log":
+			if len(args) == 2 {
+				return math.Log(args[0]) / math.Log(args[1])
+			}
+			return math.Log(args[0])
+		case "min", "max":
+			result := args[0]
+			for _, arg := range args[1:] {
+				if n.Value == "min" {
+					result = math.Min(result, arg)
+				} else {
+					result = math.Max(result, arg)
+				}
+			}
+			return result
+		}
+		t.Fatalf("unexpected function %q", n.Value)
+	}
+	if n.Left == nil && n.Right == nil {
+		v, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			t.Fatalf("unexpected leaf %q", n.Value)
+		}
+		return v
+	}
+	switch n.Value {
+	case "neg":
+		return -evalTree(t, n.Left)
+	case "+":
+		return evalTree(t, n.Left) + evalTree(t, n.Right)
+	case "-":
+		return evalTree(t, n.Left) - evalTree(t, n.Right)
+	case "*":
+		return evalTree(t, n.Left) * evalTree(t, n.Right)
+	case "/":
+		return evalTree(t, n.Left) / evalTree(t, n.Right)
+	case "^":
+		return math.Pow(evalTree(t, n.Left), evalTree(t, n.Right))
+	}
+	t.Fatalf("unexpected operator %q", n.Value)
+	return 0
+}
+
+func TestBuildExpressionTree_Unary(t *testing.T) {
+	cases := map[string]float64{
+		"-3+5":      2,
+		"2*(-4)":    -8,
+		"-(1+2)":    -3,
+		"+4-+2":     2,
+		"--3":       3,
+		"2*-3+1":    -5,
+		"-2*-2":     4,
+		"10/-2-1":   -6,
+		"(-1)-(-1)": 0,
+	}
+	for expr, want := range cases {
+		tokens, err := tokenize(expr)
+		if err != nil {
+			t.Fatalf("tokenize(%q): %v", expr, err)
+		}
+		tree, err := buildExpressionTree(tokens)
+		if err != nil {
+			t.Fatalf("buildExpressionTree(%q): %v", expr, err)
+		}
+		if got := evalTree(t, tree); got != want {
+			t.Errorf("%s: expected %v, got %v", expr, want, got)
+		}
+	}
+
+	for _, expr := range []string{"-", "2*-", "3-"} {
+		tokens, err := tokenize(expr)
+		if err != nil {
+			continue
+		}
+		if _, err := buildExpressionTree(tokens); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
+
+func TestProcessExpression_UnaryTask(t *testing.T) {
+	tokens, _ := tokenize("-(1+2)")
+	tree, err := buildExpressionTree(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := createTasksFromTree(store.New(), "expr-test", tree, nil)
+	if len(tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(tasks))
+	}
+	neg := tasks[1]
+	if neg.Operator != "neg" || len(neg.Args) != 1 || neg.Args[0] != "task:"+tasks[0].ID {
+		t.Errorf("unexpected negation task: %+v", neg)
+	}
+}
+
+func TestBuildExpressionTree_Power(t *testing.T) {
+	cases := map[string]float64{
+		"2^3":     8,
+		"2**3":    8,
+		"2^3^2":   512,
+		"2**3**2": 512,
+		"(2^3)^2": 64,
+		"2*3^2":   18,
+		"-2^2":    -4,
+		"2^-1":    0.5,
+		"2^3*2":   16,
+		"4^0.5+1": 3,
+	}
+	for expr, want := range cases {
+		tokens, err := tokenize(expr)
+		if err != nil {
+			t.Fatalf("tokenize(%q): %v", expr, err)
+		}
+		tree, err := buildExpressionTree(tokens)
+		if err != nil {
+			t.Fatalf("buildExpressionTree(%q): %v", expr, err)
+		}
+		if got := evalTree(t, tree); got != want {
+			t.Errorf("%s: expected %v, got %v", expr, want, got)
+		}
+	}
+
+	if err := ValidateExpression("2^3**2"); err != nil {
+		t.Errorf("expected power expression to be valid, got %v", err)
+	}
+}
+
+func TestBuildExpressionTree_Functions(t *testing.T) {
+	cases := map[string]float64{
+		"sqrt(16)+max(3, 7, 2)":   11,
+		"abs(-5)":                 5,
+		"min(4)":                  4,
+		"max(1,min(5,2),-3)":      2,
+		"pow(2,3)^2":              64,
+		"log(8,2)":                3,
+		"-sqrt(9)*2":              -6,
+		"max((1+2)*3, 4)":         9,
+		"sqrt (16) + max\t(1, 2)": 6,
+	}
+	for expr, want := range cases {
+		if err := ValidateExpression(expr); err != nil {
+			t.Fatalf("ValidateExpression(%q): %v", expr, err)
+		}
+		tokens, err := tokenize(expr)
+		if err != nil {
+			t.Fatalf("tokenize(%q): %v", expr, err)
+		}
+		tree, err := buildExpressionTree(tokens)
+		if err != nil {
+			t.Fatalf("buildExpressionTree(%q): %v", expr, err)
+		}
+		if got := evalTree(t, tree); got != want {
+			t.Errorf("%s: expected %v, got %v", expr, want, got)
+		}
+	}
+
+	invalid := []string{
+		"sqrt(1,2)",
+		"pow(2)",
+		"max()",
+		"max(1,,2)",
+		"max(1,)",
+		"(1,2)",
+		"1,2",
+		"foo(1)",
+		"sqrt",
+		"()",
+	}
+	for _, expr := range invalid {
+		tokens, err := tokenize(expr)
+		if err != nil {
+			continue
+		}
+		if _, err := buildExpressionTree(tokens); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
+
+func TestCreateTasksFromTree_Functions(t *testing.T) {
+	tokens, _ := tokenize("max(1+2, 3, 4)")
+	tree, err := buildExpressionTree(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := createTasksFromTree(store.New(), "expr-test", tree, nil)
+	if len(tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(tasks))
+	}
+	call := tasks[1]
+	want := []string{"task:" + tasks[0].ID, "3", "4"}
+	if call.Operator != "max" || strings.Join(call.Args, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected function task: %+v", call)
+	}
+}
+
+func TestCreateTasksFromTree_Variables(t *testing.T) {
+	tokens, err := tokenize("x*2+y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := buildExpressionTree(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]float64{"x": 3, "y": -0.5}
+	if err := checkVariables(tree, vars); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tasks := createTasksFromTree(store.New(), "expr-test", tree, vars)
+	if len(tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(tasks))
+	}
+	if got := strings.Join(tasks[0].Args, ","); got != "3,2" {
+		t.Errorf("expected x to be substituted, got args %s", got)
+	}
+	if got := strings.Join(tasks[1].Args, ","); got != "task:"+tasks[0].ID+",-0.5" {
+		t.Errorf("expected y to be substituted, got args %s", got)
+	}
+}
+
+func TestCreateTasksFromTree_VariableNamedLikeOperator(t *testing.T) {
+	// neg — внутреннее имя унарного минуса, но может быть и именем переменной
+	st := store.New()
+	expr, err := ProcessExpression(st, "neg+1", Options{Variables: map[string]float64{"neg": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := st.GetReadyTasks("", 10)
+	if len(tasks) != 1 || tasks[0].Operator != "+" || strings.Join(tasks[0].Args, ",") != "2,1" {
+		t.Fatalf("expected a single task +(2, 1), got %+v", tasks)
+	}
+	if res, _ := st.GetExpression(expr.ID); res.Status != "pending" {
+		t.Errorf("expected pending, got %s", res.Status)
+	}
+	if tree := parseTree(t, "-neg"); tree.String() != "-neg" {
+		t.Errorf("expected -neg, got %s", tree.String())
+	}
+}
+
+func TestProcessExpression_UnboundVariable(t *testing.T) {
+	_, err := ProcessExpression(store.New(), "x*2+y", Options{Variables: map[string]float64{"x": 3}})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Code != ErrCodeUnboundVariable {
+		t.Fatalf("expected unbound variable error, got %v", err)
+	}
+	if parseErr.Token != "y" || parseErr.Position != 4 {
+		t.Errorf("expected missing variable y at 4, got %q at %d", parseErr.Token, parseErr.Position)
+	}
+
+	for _, expr := range []string{"sqrt+1", "foo(2)"} {
+		if _, err := ProcessExpression(store.New(), expr, Options{}); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
+
+func TestProcessExpression_ParseErrors(t *testing.T) {
+	cases := []struct {
+		expr     string
+		code     string
+		position int
+		token    string
+	}{
+		{"1+2a", ErrCodeInvalidSymbol, 3, "a"},
+		{"1 + $", ErrCodeInvalidSymbol, 4, "$"},
+		{"1.2.3+1", ErrCodeInvalidNumber, 0, "1.2.3"},
+		{"2 * .", ErrCodeInvalidNumber, 4, "."},
+		{"1e+", ErrCodeInvalidNumber, 0, "1e+"},
+		{"1+2e", ErrCodeInvalidNumber, 2, "2e"},
+		{"1e999", ErrCodeInvalidNumber, 0, "1e999"},
+		{"1+(2*3", ErrCodeUnbalancedParentheses, 2, "("},
+		{"1+2)*3", ErrCodeUnbalancedParentheses, 3, ")"},
+		{"1 + * 2", ErrCodeUnexpectedToken, 4, "*"},
+		{"2 ** / 3", ErrCodeUnexpectedToken, 5, "/"},
+		{"2 * ** 3", ErrCodeUnexpectedToken, 4, "**"},
+		{"2 + -* 3", ErrCodeUnexpectedToken, 5, "*"},
+		{"1 2", ErrCodeUnexpectedToken, 2, "2"},
+		{"(1)(2)", ErrCodeUnexpectedToken, 3, "("},
+		{"max(1,,2)", ErrCodeUnexpectedToken, 6, ","},
+		{"(1, 2)", ErrCodeUnexpectedToken, 2, ","},
+		{"()", ErrCodeUnexpectedToken, 1, ")"},
+		{"3 -", ErrCodeUnexpectedEnd, 3, ""},
+		{"  ", ErrCodeEmptyExpression, 0, ""},
+		{"foo(1)", ErrCodeUnknownFunction, 0, "foo"},
+		{"1 + sqrt(1, 2)", ErrCodeWrongArgumentCount, 4, "sqrt"},
+		{"x + 1", ErrCodeUnboundVariable, 0, "x"},
+	}
+	for _, c := range cases {
+		_, err := ProcessExpression(store.New(), c.expr, Options{})
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%q: expected ParseError, got %v", c.expr, err)
+			continue
+		}
+		if parseErr.Code != c.code || parseErr.Position != c.position || parseErr.Token != c.token {
+			t.Errorf("%q: expected %s at %d (%q), got %s at %d (%q)", c.expr,
+				c.code, c.position, c.token, parseErr.Code, parseErr.Position, parseErr.Token)
+		}
+	}
+}
+
+func TestTokenize_Numbers(t *testing.T) {
+	cases := map[string]string{
+		"12":      "12",
+		".5":      ".5",
+		"3.":      "3.",
+		"3.14":    "3.14",
+		"1e-3":    "1e-3",
+		"6.02E23": "6.02E23",
+		"2e+10":   "2e+10",
+	}
+	for expr, want := range cases {
+		tokens, err := tokenize(expr)
+		if err != nil {
+			t.Errorf("tokenize(%q): %v", expr, err)
+			continue
+		}
+		if len(tokens) != 1 || tokens[0].type_ != number || tokens[0].value != want {
+			t.Errorf("tokenize(%q): expected single number %s, got %+v", expr, want, tokens)
+		}
+	}
+
+	tokens, err := tokenize("1e-3-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 3 || tokens[0].value != "1e-3" || tokens[1].value != "-" || tokens[2].value != "2" {
+		t.Errorf("unexpected tokens for 1e-3-2: %+v", tokens)
+	}
+
+	for _, expr := range []string{"1.2.3", ".", "..", "1e", "1e+", "2.5E-"} {
+		if _, err := tokenize(expr); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
+
+func TestInsertImplicitMultiplication(t *testing.T) {
+	cases := map[string]float64{
+		"2(3+4)":      14,
+		"(1+2)(3+4)":  21,
+		"(1+2)3":      9,
+		"2(3)(4)":     24,
+		"-2(3)^2":     -18,
+		"max(1,2)(3)": 6,
+		"(2)(-3)":     -6,
+		"1.5(2)-(1)2": 1,
+	}
+	for expr, want := range cases {
+		tokens, err := tokenize(expr)
+		if err != nil {
+			t.Fatalf("tokenize(%q): %v", expr, err)
+		}
+		tree, err := buildExpressionTree(insertImplicitMultiplication(tokens))
+		if err != nil {
+			t.Fatalf("buildExpressionTree(%q): %v", expr, err)
+		}
+		if got := evalTree(t, tree); got != want {
+			t.Errorf("%s: expected %v, got %v", expr, want, got)
+		}
+	}
+
+	// Без опции выражение остаётся строгим
+	if _, err := ProcessExpression(store.New(), "2(3+4)", Options{}); err == nil {
+		t.Error("expected error for implicit multiplication in strict mode")
+	}
+	if _, err := ProcessExpression(store.New(), "2(3+4)", Options{ImplicitMultiplication: true}); err != nil {
+		t.Errorf("expected implicit multiplication to be accepted, got %v", err)
+	}
+}
+
+func TestGenerateTaskID_SkipsExisting(t *testing.T) {
+	st := store.New()
+	next := "task-" + strconv.FormatUint(taskCounter+1, 10)
+	expr := st.NewExpression("1+1", nil)
+	st.RegisterTasks(expr.ID, []*store.Task{{ID: next, ExpressionID: expr.ID, Args: []string{"1", "1"}, Operator: "+"}})
+
+	if id := generateTaskID(st); id == next {
+		t.Errorf("expected %s to be skipped as already used", next)
+	}
 }
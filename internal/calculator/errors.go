@@ -0,0 +1,46 @@
+package calculator
+
+import "fmt"
+
+// Коды ошибок разбора выражения, возвращаемые клиенту
+const (
+	ErrCodeInvalidSymbol         = "invalid_symbol"
+	ErrCodeUnbalancedParentheses = "unbalanced_parentheses"
+	ErrCodeInvalidNumber         = "invalid_number"
+	ErrCodeUnexpectedToken       = "unexpected_token"
+	ErrCodeUnexpectedEnd         = "unexpected_end"
+	ErrCodeEmptyExpression       = "empty_expression"
+	ErrCodeUnknownFunction       = "unknown_function"
+	ErrCodeWrongArgumentCount    = "wrong_argument_count"
+	ErrCodeUnboundVariable       = "unbound_variable"
+)
+
+// ParseError описывает ошибку разбора выражения: что пошло не так и где.
+// Position — смещение в символах от начала исходной строки выражения.
+type ParseError struct {
+	Code     string
+	Message  string
+	Position int
+	Token    string
+}
+
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+	}
+	return fmt.Sprintf("%s at position %d: %q", e.Message, e.Position, e.Token)
+}
+
+func newParseError(code string, pos int, tok string, format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+		Position: pos,
+		Token:    tok,
+	}
+}
+
+// unexpectedToken сообщает о токене, который не может стоять в этом месте выражения
+func unexpectedToken(t token) *ParseError {
+	return newParseError(ErrCodeUnexpectedToken, t.pos, t.text, "unexpected token")
+}
@@ -0,0 +1,115 @@
+package calculator
+
+import (
+	"calc-service/internal/operations"
+	"calc-service/internal/store"
+	"os"
+	"strconv"
+)
+
+// Режимы вычисления выражения
+const (
+	// ModeDistributed — каждая операция выполняется агентом как отдельная задача
+	ModeDistributed = "distributed"
+	// ModeFold — дешёвые поддеревья вычисляются прямо в оркестраторе
+	ModeFold = "fold"
+)
+
+// Порог стоимости свёртки по умолчанию, мс
+const defaultFoldThreshold = 200
+
+// getFoldThreshold возвращает порог стоимости поддерева, ниже которого
+// оно сворачивается локально. Берётся из FOLD_THRESHOLD_MS.
+func getFoldThreshold() int {
+	t, err := strconv.Atoi(os.Getenv("FOLD_THRESHOLD_MS"))
+	if err != nil || t < 0 {
+		return defaultFoldThreshold
+	}
+	return t
+}
+
+// subtreeCost возвращает суммарное время выполнения задач поддерева
+func subtreeCost(node *Node) int {
+	cost := 0
+	if isTaskNode(node) {
+		cost = getOperationTime(node.Value)
+	}
+	for _, operand := range node.operands() {
+		cost += subtreeCost(operand)
+	}
+	return cost
+}
+
+// evaluateTree вычисляет поддерево локально теми же операциями, что и агент
+func evaluateTree(node *Node, variables map[string]float64) (float64, error) {
+	if !isTaskNode(node) {
+		if node.Variable {
+			return variables[node.Value], nil
+		}
+		return strconv.ParseFloat(node.Value, 64)
+	}
+	operands := node.operands()
+	args := make([]float64, len(operands))
+	for i, operand := range operands {
+		value, err := evaluateTree(operand, variables)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+	// Apply возвращает ошибку и для бесконечного результата или NaN
+	return operations.Apply(node.Value, args)
+}
+
+// foldConstants заменяет листьями с результатом максимальные поддеревья,
+// стоимость которых не превышает threshold. Поддеревья, вычисление которых
+// завершается ошибкой (например, деление на ноль или переполнение), остаются агентам.
+func foldConstants(node *Node, variables map[string]float64, threshold int) (*Node, []store.FoldedNode) {
+	if !isTaskNode(node) {
+		return node, nil
+	}
+	if subtreeCost(node) <= threshold {
+		if value, err := evaluateTree(node, variables); err == nil {
+			folded := store.FoldedNode{Expression: node.String(), Result: value}
+			leaf := &Node{Value: strconv.FormatFloat(value, 'g', -1, 64), Pos: node.Pos}
+			return leaf, []store.FoldedNode{folded}
+		}
+	}
+
+	var folded []store.FoldedNode
+	var f []store.FoldedNode
+	if node.Args != nil {
+		for i, arg := range node.Args {
+			node.Args[i], f = foldConstants(arg, variables, threshold)
+			folded = append(folded, f...)
+		}
+		return node, folded
+	}
+	if node.Left != nil {
+		node.Left, f = foldConstants(node.Left, variables, threshold)
+		folded = append(folded, f...)
+	}
+	if node.Right != nil {
+		node.Right, f = foldConstants(node.Right, variables, threshold)
+		folded = append(folded, f...)
+	}
+	return node, folded
+}
+
+// distributedNodes перечисляет узлы дерева, отправленные агентам в виде задач.
+// Общее подвыражение попадает в список один раз.
+func distributedNodes(node *Node) []store.DistributedNode {
+	return collectDistributed(node, make(map[string]bool))
+}
+
+func collectDistributed(node *Node, seen map[string]bool) []store.DistributedNode {
+	var result []store.DistributedNode
+	for _, operand := range node.operands() {
+		result = append(result, collectDistributed(operand, seen)...)
+	}
+	if isTaskNode(node) && !seen[node.TaskID] {
+		seen[node.TaskID] = true
+		result = append(result, store.DistributedNode{Expression: node.String(), TaskID: node.TaskID})
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"os"
+	"testing"
+)
+
+func parseTree(t *testing.T, expr string) *Node {
+	t.Helper()
+	tokens, err := tokenize(expr)
+	if err != nil {
+		t.Fatalf("tokenize(%q): %v", expr, err)
+	}
+	tree, err := buildExpressionTree(tokens)
+	if err != nil {
+		t.Fatalf("buildExpressionTree(%q): %v", expr, err)
+	}
+	return tree
+}
+
+func TestFoldConstants(t *testing.T) {
+	os.Setenv("TIME_ADDITION_MS", "10")
+	os.Setenv("TIME_MULTIPLICATIONS_MS", "100")
+	os.Setenv("TIME_DIVISIONS_MS", "10")
+
+	// (1+2) и (3+4) стоят по 10 мс, всё выражение — 120 мс
+	tree, folded := foldConstants(parseTree(t, "(1+2)*(3+4)"), nil, 50)
+	if len(folded) != 2 {
+		t.Fatalf("expected 2 folded subtrees, got %+v", folded)
+	}
+	if folded[0] != (store.FoldedNode{Expression: "(1+2)", Result: 3}) ||
+		folded[1] != (store.FoldedNode{Expression: "(3+4)", Result: 7}) {
+		t.Errorf("unexpected folded subtrees: %+v", folded)
+	}
+	if tree.String() != "(3*7)" {
+		t.Errorf("expected (3*7), got %s", tree.String())
+	}
+
+	tree, folded = foldConstants(parseTree(t, "(1+2)*(3+4)"), nil, 1000)
+	if len(folded) != 1 || tree.String() != "21" {
+		t.Errorf("expected whole tree folded to 21, got %s (%+v)", tree.String(), folded)
+	}
+
+	// Деление на ноль не сворачивается и остаётся агентам
+	tree, folded = foldConstants(parseTree(t, "1/0+x"), map[string]float64{"x": 1}, 1000)
+	if len(folded) != 0 || tree.String() != "((1/0)+x)" {
+		t.Errorf("expected failing subtree to stay distributed, got %s (%+v)", tree.String(), folded)
+	}
+}
+
+func TestProcessExpression_FoldOverflow(t *testing.T) {
+	os.Setenv("TIME_POWER_MS", "10")
+
+	// Переполнение не сворачивается: задача уходит агенту, и выражение завершится ошибкой
+	st := store.New()
+	expr, err := ProcessExpression(st, "10^400", Options{Mode: ModeFold, FoldThreshold: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := st.GetExpression(expr.ID)
+	if res.Status != "pending" || len(res.Folded) != 0 {
+		t.Errorf("expected the overflowing subtree to stay distributed, got %+v", res)
+	}
+	if task, ok := st.GetReadyTask(""); !ok || task.Operator != "^" {
+		t.Errorf("expected a ^ task, got %+v", task)
+	}
+}
+
+func TestProcessExpression_FoldMode(t *testing.T) {
+	os.Setenv("TIME_ADDITION_MS", "10")
+	os.Setenv("TIME_MULTIPLICATIONS_MS", "100")
+
+	st := store.New()
+	expr, err := ProcessExpression(st, "(1+2)*(3+x)", Options{
+		Variables:     map[string]float64{"x": 4},
+		Mode:          ModeFold,
+		FoldThreshold: 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Mode != ModeFold || len(expr.Folded) != 2 || len(expr.Distributed) != 1 {
+		t.Fatalf("unexpected evaluation plan: %+v", expr)
+	}
+	task, found := st.GetTask(expr.Distributed[0].TaskID)
+	if !found || task.Operator != "*" || task.Args[0] != "3" || task.Args[1] != "7" {
+		t.Errorf("unexpected distributed task: %+v", task)
+	}
+
+	expr, err = ProcessExpression(st, "1+1", Options{Mode: ModeFold, FoldThreshold: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Status != "done" || expr.Result != 2 {
+		t.Errorf("expected fully folded expression to be done with 2, got %s %v", expr.Status, expr.Result)
+	}
+}
+
+func TestProcessExpression_NoOperations(t *testing.T) {
+	expr, err := ProcessExpression(store.New(), "x", Options{Variables: map[string]float64{"x": 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Status != "done" || expr.Result != 5 {
+		t.Errorf("expected expression without operations to be done with 5, got %s %v", expr.Status, expr.Result)
+	}
+}
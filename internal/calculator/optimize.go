@@ -0,0 +1,58 @@
+package calculator
+
+// isAssociative сообщает, можно ли перегруппировывать цепочку оператора op
+func isAssociative(op string) bool {
+	return op == "+" || op == "*"
+}
+
+// flattenChain собирает операнды цепочки одного ассоциативного оператора
+// слева направо: ((a+b)+c)+d -> [a b c d]
+func flattenChain(node *Node, op string) []*Node {
+	if node.Value != op || node.Args != nil || node.Right == nil {
+		return []*Node{node}
+	}
+	return append(flattenChain(node.Left, op), flattenChain(node.Right, op)...)
+}
+
+// balanceChain строит из операндов сбалансированное дерево оператора op,
+// сохраняя их порядок
+func balanceChain(operands []*Node, op string, pos int) *Node {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	mid := len(operands) / 2
+	return &Node{
+		Value:    op,
+		Left:     balanceChain(operands[:mid], op, pos),
+		Right:    balanceChain(operands[mid:], op, pos),
+		Pos:      pos,
+		Priority: precedence(op),
+	}
+}
+
+// rebalance перестраивает цепочки сложений и умножений в сбалансированные
+// деревья: 1+2+3+4 вычисляется как (1+2)+(3+4), и независимые задачи
+// выполняются агентами параллельно. Критический путь сокращается с O(n)
+// до O(log n), но порядок округления чисел с плавающей точкой меняется.
+func rebalance(node *Node) *Node {
+	if node.Args != nil {
+		for i, arg := range node.Args {
+			node.Args[i] = rebalance(arg)
+		}
+		return node
+	}
+	if isAssociative(node.Value) && node.Right != nil {
+		operands := flattenChain(node, node.Value)
+		for i, operand := range operands {
+			operands[i] = rebalance(operand)
+		}
+		return balanceChain(operands, node.Value, node.Pos)
+	}
+	if node.Left != nil {
+		node.Left = rebalance(node.Left)
+	}
+	if node.Right != nil {
+		node.Right = rebalance(node.Right)
+	}
+	return node
+}
@@ -0,0 +1,86 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"testing"
+)
+
+func treeDepth(n *Node) int {
+	depth := 0
+	for _, operand := range n.operands() {
+		if d := treeDepth(operand); d > depth {
+			depth = d
+		}
+	}
+	if isTaskNode(n) {
+		depth++
+	}
+	return depth
+}
+
+func TestRebalance(t *testing.T) {
+	cases := []struct {
+		expr  string
+		depth int
+		want  string
+	}{
+		{"1+2+3+4+5+6+7+8", 3, "(((1+2)+(3+4))+((5+6)+(7+8)))"},
+		{"1*2*3*4*5", 3, "((1*2)*(3*(4*5)))"},
+		{"1+2*3*4+5", 4, "(1+((2*(3*4))+5))"},
+		{"1-2-3-4", 3, "(((1-2)-3)-4)"},
+		{"max(1+2+3+4, 5)", 3, "max(((1+2)+(3+4)), 5)"},
+		{"-(1+2+3+4)", 3, "-((1+2)+(3+4))"},
+	}
+	for _, c := range cases {
+		original := parseTree(t, c.expr)
+		want := evalTree(t, original)
+		tree := rebalance(parseTree(t, c.expr))
+		if tree.String() != c.want {
+			t.Errorf("%s: expected %s, got %s", c.expr, c.want, tree.String())
+		}
+		if d := treeDepth(tree); d != c.depth {
+			t.Errorf("%s: expected depth %d, got %d", c.expr, c.depth, d)
+		}
+		if got := evalTree(t, tree); got != want {
+			t.Errorf("%s: expected %v, got %v", c.expr, want, got)
+		}
+	}
+}
+
+func TestProcessExpression_PreserveOrder(t *testing.T) {
+	expr, err := ProcessExpression(store.New(), "1+2+3+4", Options{PreserveOrder: true, Mode: ModeFold, FoldThreshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(expr.Distributed); n != 3 || expr.Distributed[2].Expression != "(((1+2)+3)+4)" {
+		t.Errorf("expected left-deep chain to be kept, got %+v", expr.Distributed)
+	}
+}
+
+func TestCreateTasksFromTree_CommonSubexpressions(t *testing.T) {
+	cases := []struct {
+		expr  string
+		vars  map[string]float64
+		tasks int
+	}{
+		{"(a+b)*(a+b)", map[string]float64{"a": 1, "b": 2}, 2},
+		{"(a+b)*(1+2)", map[string]float64{"a": 1, "b": 2}, 2},
+		{"(1+2)*(2+1)", nil, 2},
+		{"(1.0+2)-(1+2.00)", nil, 2},
+		{"(1-2)*(2-1)", nil, 3},
+		{"sqrt(4)+sqrt(4)*sqrt(4)", nil, 3},
+		{"max(1+1, 1+1, 2)", nil, 2},
+	}
+	for _, c := range cases {
+		tasks := createTasksFromTree(store.New(), "expr-test", parseTree(t, c.expr), c.vars)
+		if len(tasks) != c.tasks {
+			t.Errorf("%s: expected %d tasks, got %d", c.expr, c.tasks, len(tasks))
+		}
+	}
+
+	tasks := createTasksFromTree(store.New(), "expr-test", parseTree(t, "(a+b)*(a+b)"), map[string]float64{"a": 1, "b": 2})
+	shared := "task:" + tasks[0].ID
+	if root := tasks[1]; root.Args[0] != shared || root.Args[1] != shared {
+		t.Errorf("expected both arguments to reference %s, got %v", shared, root.Args)
+	}
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"calc-service/internal/agentpb"
+	"calc-service/internal/store"
+	"calc-service/pkg/logger"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AgentServer serves agents over gRPC. It hands out the same tasks as the
+// HTTP internal API, so agents of both kinds can work on one expression.
+type AgentServer struct {
+	agentpb.UnimplementedAgentServiceServer
+	store *store.Store
+}
+
+// NewAgentServer creates a gRPC agent service backed by st
+func NewAgentServer(st *store.Store) *AgentServer {
+	return &AgentServer{store: st}
+}
+
+// Connect pushes ready tasks to the agent while it has free slots and
+// applies the results and heartbeats it streams back
+func (s *AgentServer) Connect(stream agentpb.AgentService_ConnectServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := first.GetHello()
+	if hello == nil || hello.Capacity < 1 {
+		return status.Error(codes.InvalidArgument, "the first message must be hello with a positive capacity")
+	}
+
+	agent := s.store.RegisterAgent(store.Agent{
+		Hostname:       hello.Hostname,
+		ComputingPower: int(hello.Capacity),
+		Operators:      hello.Operators,
+		Version:        hello.Version,
+	})
+	logger.Info("Agent %s (%s) connected over gRPC", agent.ID, agent.Hostname)
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go s.keepAlive(ctx, agent.ID)
+
+	// A token in slots is a task the agent can take right now
+	slots := make(chan struct{}, hello.Capacity)
+	for i := int32(0); i < hello.Capacity; i++ {
+		slots <- struct{}{}
+	}
+
+	// Dispatching stops when the agent sends Drain
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
+	defer stopDispatch()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		recvErr <- s.receive(stream, slots, stopDispatch)
+	}()
+
+	for {
+		select {
+		case <-slots:
+		case <-dispatchCtx.Done():
+			return s.drain(ctx, agent.ID, slots, hello.Capacity, recvErr)
+		}
+
+		// A task taken here is not lost if sending fails: its lease expires and it is handed out again
+		task, found := s.store.WaitReadyTask(dispatchCtx, agent.ID)
+		if !found {
+			slots <- struct{}{}
+			return s.drain(ctx, agent.ID, slots, hello.Capacity, recvErr)
+		}
+		msg := &agentpb.OrchestratorMessage{Task: toProtoTask(task)}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// drain waits until the agent reports or releases every task pushed to it,
+// i.e. all slots are free again, and then ends the stream
+func (s *AgentServer) drain(ctx context.Context, agentID string, slots <-chan struct{}, capacity int32, recvErr <-chan error) error {
+	if ctx.Err() != nil {
+		// The stream itself has ended
+		return streamError(<-recvErr)
+	}
+	for i := int32(0); i < capacity; i++ {
+		select {
+		case <-slots:
+		case <-ctx.Done():
+			return streamError(<-recvErr)
+		}
+	}
+	logger.Info("Agent %s drained and disconnected", agentID)
+	return nil
+}
+
+// keepAlive marks the agent as seen while its stream is open
+func (s *AgentServer) keepAlive(ctx context.Context, agentID string) {
+	ticker := time.NewTicker(store.AgentHeartbeat())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.store.TouchAgent(agentID)
+		}
+	}
+}
+
+// receive applies messages from the agent until the stream ends.
+// Every result or released task frees a slot for the next task.
+func (s *AgentServer) receive(stream agentpb.AgentService_ConnectServer, slots chan<- struct{}, stopDispatch func()) error {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch payload := msg.Payload.(type) {
+		case *agentpb.AgentMessage_Result:
+			r := payload.Result
+			if err := reportTaskResult(s.store, r.Id, r.Result, r.Error); err != nil {
+				logger.Error("Failed to complete task: %v", err)
+			}
+			select {
+			case slots <- struct{}{}:
+			default:
+			}
+		case *agentpb.AgentMessage_Release:
+			logger.Info("Agent released task %s", payload.Release.Id)
+			select {
+			case slots <- struct{}{}:
+			default:
+			}
+		case *agentpb.AgentMessage_Heartbeat:
+			hb := payload.Heartbeat
+			if err := s.store.RenewLease(hb.Id, int(hb.Redispatches)); err != nil {
+				logger.Debug("Heartbeat rejected: %v", err)
+			}
+		case *agentpb.AgentMessage_Drain:
+			logger.Info("Agent is shutting down, no more tasks will be pushed")
+			stopDispatch()
+		}
+	}
+}
+
+func toProtoTask(task *store.Task) *agentpb.Task {
+	return &agentpb.Task{
+		Id:            task.ID,
+		ExpressionId:  task.ExpressionID,
+		Args:          task.Args,
+		Operation:     task.Operator,
+		OperationTime: int32(task.OperationTime),
+		Redispatches:  int32(task.Redispatches),
+		LeaseMs:       store.LeaseDuration().Milliseconds(),
+	}
+}
+
+// streamError hides the error of an agent closing the stream normally
+func streamError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
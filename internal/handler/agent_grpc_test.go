@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"calc-service/internal/agentpb"
+	"calc-service/internal/calculator"
+	"calc-service/internal/store"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func dialAgentServer(t *testing.T, st *store.Store) agentpb.AgentServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	agentpb.RegisterAgentServiceServer(server, NewAgentServer(st))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return agentpb.NewAgentServiceClient(conn)
+}
+
+func TestAgentServer_Connect(t *testing.T) {
+	st := store.New()
+	client := dialAgentServer(t, st)
+	expr, err := calculator.ProcessExpression(st, "(1+2)*4", calculator.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Hello{Hello: &agentpb.Hello{Capacity: 1}}}
+	if err := stream.Send(hello); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tasks are pushed one at a time, each after the result of the previous one
+	for _, want := range []struct {
+		operation string
+		result    float64
+	}{{"+", 3}, {"*", 12}} {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Task.Operation != want.operation || msg.Task.LeaseMs <= 0 {
+			t.Fatalf("unexpected task: %v", msg.Task)
+		}
+		result := &agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Result{
+			Result: &agentpb.TaskResult{Id: msg.Task.Id, Result: want.result},
+		}}
+		if err := stream.Send(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.CloseSend()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if res, _ := st.GetExpression(expr.ID); res.Status == "done" {
+			if res.Result != 12 {
+				t.Errorf("expected 12, got %v", res.Result)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expression was not completed")
+}
+
+func TestAgentServer_Drain(t *testing.T) {
+	st := store.New()
+	client := dialAgentServer(t, st)
+	if _, err := calculator.ProcessExpression(st, "(1+2)*(3+4)", calculator.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Hello{Hello: &agentpb.Hello{Capacity: 1}}}
+	if err := stream.Send(hello); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drain := &agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Drain{Drain: &agentpb.Drain{}}}
+	if err := stream.Send(drain); err != nil {
+		t.Fatal(err)
+	}
+	result := &agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Result{
+		Result: &agentpb.TaskResult{Id: msg.Task.Id, Result: 3},
+	}}
+	if err := stream.Send(result); err != nil {
+		t.Fatal(err)
+	}
+
+	// After the result of the task in progress the stream ends without new tasks
+	if msg, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("expected the stream to end, got %v, %v", msg, err)
+	}
+	if task, _ := st.GetTask(msg.Task.Id); !task.Completed {
+		t.Error("the result sent after drain was not applied")
+	}
+	if tasks := st.GetReadyTasks("", 10); len(tasks) != 1 {
+		t.Errorf("expected the other task to stay queued, got %d", len(tasks))
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type RegisterAgentRequest struct {
+	Hostname       string   `json:"hostname"`
+	ComputingPower int      `json:"computing_power"`
+	Operators      []string `json:"operators"`
+	Version        string   `json:"version"`
+}
+
+type RegisterAgentResponse struct {
+	ID string `json:"id"`
+	// HeartbeatMs is how often the agent should call the heartbeat endpoint
+	HeartbeatMs int64 `json:"heartbeat_ms"`
+}
+
+type AgentsResponse struct {
+	Agents []store.AgentStatus `json:"agents"`
+}
+
+// HandleRegisterAgent registers an agent and returns its ID
+func (h *Handler) HandleRegisterAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RegisterAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		return
+	}
+
+	agent := h.store.RegisterAgent(store.Agent{
+		Hostname:       req.Hostname,
+		ComputingPower: req.ComputingPower,
+		Operators:      req.Operators,
+		Version:        req.Version,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(RegisterAgentResponse{
+		ID:          agent.ID,
+		HeartbeatMs: store.AgentHeartbeat().Milliseconds(),
+	})
+}
+
+// HandleAgentHeartbeat handles POST /internal/agents/{id}/heartbeat.
+// 404 Not Found tells the agent to register again.
+func (h *Handler) HandleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/internal/agents/"), "/heartbeat")
+	if !ok || id == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	err := h.store.TouchAgent(id)
+	switch {
+	case errors.Is(err, store.ErrAgentNotFound):
+		http.Error(w, "Agent not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// HandleAgents lists live and dead agents with the tasks they currently hold
+func (h *Handler) HandleAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AgentsResponse{Agents: h.store.ListAgents(time.Now())})
+}
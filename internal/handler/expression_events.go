@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sseKeepAlive is how often a comment is written to an idle event stream,
+// so that proxies do not close it
+const sseKeepAlive = 15 * time.Second
+
+// handleExpressionEvents streams the progress of an expression as Server-Sent
+// Events: one event per dispatched, completed or failed task and a final
+// "finished" event carrying the expression as returned by GET. The stream
+// ends after the final event. Events are not numbered and Last-Event-ID is
+// not honored: a stream only carries what happens while it is open.
+func (h *Handler) handleExpressionEvents(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the status, so the final event cannot slip in between
+	events, unsubscribe := h.store.Subscribe(id)
+	defer unsubscribe()
+	expr, exists := h.store.GetExpression(id)
+	if !exists {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if expr.Status != "pending" {
+		writeEvent(w, store.EventFinished, newExpressionResponse(expr))
+		flusher.Flush()
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// The subscriber fell behind and was dropped. Events carry no IDs
+				// and are not replayed, so a client that reconnects only gets new
+				// events and has to re-read the expression for what it missed.
+				return
+			}
+			if event.Type == store.EventFinished {
+				if expr, exists := h.store.GetExpression(id); exists {
+					writeEvent(w, store.EventFinished, newExpressionResponse(expr))
+					flusher.Flush()
+				}
+				return
+			}
+			writeEvent(w, event.Type, event)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes one Server-Sent Event with a JSON payload
+func writeEvent(w http.ResponseWriter, name string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"bufio"
+	"calc-service/internal/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleExpressionEvents(t *testing.T) {
+	h := New(store.New())
+	rec := postCalculate(t, h, `{"expression": "2*3"}`)
+	var created CalculateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(h.HandleExpressionByID))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/api/v1/expressions/" + created.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %s", resp.StatusCode, ct)
+	}
+
+	task, ok := h.store.GetReadyTask("agent-1")
+	if !ok {
+		t.Fatal("no ready task")
+	}
+	if err := h.store.CompleteTask(task.ID, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream ends after the finished event
+	var names []string
+	var finished ExpressionResponse
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, found := strings.CutPrefix(line, "event: "); found {
+			names = append(names, name)
+		}
+		if data, found := strings.CutPrefix(line, "data: "); found && names[len(names)-1] == "finished" {
+			if err := json.Unmarshal([]byte(data), &finished); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got := strings.Join(names, ","); got != "dispatched,completed,finished" {
+		t.Errorf("unexpected events: %s", got)
+	}
+	if finished.Status != "done" || finished.Result != 6 {
+		t.Errorf("unexpected final expression: %+v", finished)
+	}
+}
+
+func TestHandleExpressionEvents_Finished(t *testing.T) {
+	h := New(store.New())
+	rec := postCalculate(t, h, `{"expression": "7"}`)
+	var created CalculateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID+"/events", nil)
+	rec = httptest.NewRecorder()
+	h.HandleExpressionByID(rec, req)
+	if body := rec.Body.String(); !strings.HasPrefix(body, "event: finished\n") || !strings.Contains(body, `"status":"done"`) {
+		t.Errorf("expected only the finished event, got %q", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/expressions/expr-unknown/events", nil)
+	rec = httptest.NewRecorder()
+	h.HandleExpressionByID(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
@@ -5,33 +5,57 @@ import (
 	"calc-service/internal/store"
 	"calc-service/pkg/logger"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type CalculateRequest struct {
-	Expression string `json:"expression"`
+	Expression             string             `json:"expression"`
+	Variables              map[string]float64 `json:"variables,omitempty"`
+	ImplicitMultiplication bool               `json:"implicit_multiplication,omitempty"`
+	Mode                   string             `json:"mode,omitempty"`
+	FoldThresholdMs        int                `json:"fold_threshold_ms,omitempty"`
+	PreserveOrder          bool               `json:"preserve_order,omitempty"`
+	// TimeoutMs limits how long the expression may take; 0 uses EXPRESSION_TIMEOUT_MS
+	TimeoutMs int `json:"timeout_ms,omitempty"`
 }
 
 type CalculateResponse struct {
 	ID string `json:"id"`
 }
 
+// ErrorResponse describes why an expression was rejected. Position is the
+// character offset of the offending token in the submitted expression.
+type ErrorResponse struct {
+	Error    string `json:"error"`
+	Code     string `json:"code"`
+	Position int    `json:"position"`
+	Token    string `json:"token,omitempty"`
+	// Variable names the variable without a value for the unbound_variable code
+	Variable string `json:"variable,omitempty"`
+}
+
 type ExpressionsResponse struct {
 	Expressions []ExpressionResponse `json:"expressions"`
 }
 
 type ExpressionResponse struct {
-	ID     string  `json:"id"`
-	Status string  `json:"status"`
-	Result float64 `json:"result,omitempty"`
+	ID          string                  `json:"id"`
+	Status      string                  `json:"status"`
+	Result      float64                 `json:"result,omitempty"`
+	Error       string                  `json:"error,omitempty"`
+	Mode        string                  `json:"mode,omitempty"`
+	Folded      []store.FoldedNode      `json:"folded,omitempty"`
+	Distributed []store.DistributedNode `json:"distributed,omitempty"`
 }
 
 type ExpressionDetailResponse struct {
 	Expression ExpressionResponse `json:"expression"`
 }
 
-func HandleCalculate(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleCalculate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -39,14 +63,54 @@ func HandleCalculate(w http.ResponseWriter, r *http.Request) {
 
 	var req CalculateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		writeError(w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error: "Invalid request body",
+			Code:  "invalid_request",
+		})
+		return
+	}
+
+	if req.Mode != "" && req.Mode != calculator.ModeDistributed && req.Mode != calculator.ModeFold {
+		writeError(w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error: "Unknown evaluation mode",
+			Code:  "invalid_request",
+			Token: req.Mode,
+		})
+		return
+	}
+
+	if req.TimeoutMs < 0 {
+		writeError(w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error: "Timeout must not be negative",
+			Code:  "invalid_request",
+		})
 		return
 	}
 
-	expr, err := calculator.ProcessExpression(req.Expression)
+	expr, err := calculator.ProcessExpression(h.store, req.Expression, calculator.Options{
+		Variables:              req.Variables,
+		ImplicitMultiplication: req.ImplicitMultiplication,
+		Mode:                   req.Mode,
+		FoldThreshold:          req.FoldThresholdMs,
+		PreserveOrder:          req.PreserveOrder,
+		Timeout:                time.Duration(req.TimeoutMs) * time.Millisecond,
+	})
 	if err != nil {
 		logger.Error("Expression processing error: %v", err)
-		http.Error(w, "Invalid expression", http.StatusUnprocessableEntity)
+		response := ErrorResponse{Error: "Invalid expression", Code: "invalid_expression"}
+		var parseErr *calculator.ParseError
+		if errors.As(err, &parseErr) {
+			response = ErrorResponse{
+				Error:    parseErr.Message,
+				Code:     parseErr.Code,
+				Position: parseErr.Position,
+				Token:    parseErr.Token,
+			}
+			if parseErr.Code == calculator.ErrCodeUnboundVariable {
+				response.Variable = parseErr.Token
+			}
+		}
+		writeError(w, http.StatusUnprocessableEntity, response)
 		return
 	}
 
@@ -55,21 +119,35 @@ func HandleCalculate(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(CalculateResponse{ID: expr.ID})
 }
 
-func HandleExpressions(w http.ResponseWriter, r *http.Request) {
+func newExpressionResponse(expr *store.Expression) ExpressionResponse {
+	return ExpressionResponse{
+		ID:          expr.ID,
+		Status:      expr.Status,
+		Result:      expr.Result,
+		Error:       expr.Error,
+		Mode:        expr.Mode,
+		Folded:      expr.Folded,
+		Distributed: expr.Distributed,
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, response ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) HandleExpressions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	expressions := store.ListExpressions()
+	expressions := h.store.ListExpressions()
 	response := make([]ExpressionResponse, 0, len(expressions))
 
 	for _, expr := range expressions {
-		response = append(response, ExpressionResponse{
-			ID:     expr.ID,
-			Status: expr.Status,
-			Result: expr.Result,
-		})
+		response = append(response, newExpressionResponse(expr))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -77,35 +155,46 @@ func HandleExpressions(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(ExpressionsResponse{Expressions: response})
 }
 
-func HandleExpressionByID(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// HandleExpressionByID returns an expression on GET and cancels it on DELETE.
+// GET /api/v1/expressions/{id}/events streams its progress instead.
+func (h *Handler) HandleExpressionByID(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/")
+	if exprID, found := strings.CutSuffix(id, "/events"); found {
+		h.handleExpressionEvents(w, r, exprID)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		err := h.store.CancelExpression(id)
+		switch {
+		case errors.Is(err, store.ErrExpressionNotFound):
+			http.Error(w, "Expression not found", http.StatusNotFound)
+			return
+		case errors.Is(err, store.ErrExpressionFinished):
+			http.Error(w, "Expression already finished", http.StatusConflict)
+			return
+		case err != nil:
+			logger.Error("Failed to cancel expression: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Expression %s cancelled", id)
+	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	id := strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/")
-	expr, exists := store.GetExpression(id)
+	expr, exists := h.store.GetExpression(id)
 	if !exists {
 		http.Error(w, "Expression not found", http.StatusNotFound)
 		return
 	}
 
-	response := ExpressionResponse{
-		ID:     expr.ID,
-		Status: expr.Status,
-		Result: expr.Result,
-	}
+	response := newExpressionResponse(expr)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(ExpressionDetailResponse{Expression: response})
 }
-
-func UpdateAllTasksReadiness() {
-	expressions := store.ListExpressions()
-	for _, expr := range expressions {
-		if expr.Status == "pending" {
-			store.UpdateTasksReadiness(expr.ID)
-		}
-	}
-}
@@ -0,0 +1,13 @@
+package handler
+
+import "calc-service/internal/store"
+
+// Handler serves the user and agent HTTP APIs on top of a store
+type Handler struct {
+	store *store.Store
+}
+
+// New creates a handler working with st
+func New(st *store.Store) *Handler {
+	return &Handler{store: st}
+}
@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postCalculate(t *testing.T, h *Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.HandleCalculate(rec, req)
+	return rec
+}
+
+func TestHandleCalculate_IsolatedStores(t *testing.T) {
+	first, second := New(store.New()), New(store.New())
+
+	rec := postCalculate(t, first, `{"expression": "2+2*2"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var created CalculateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := first.store.GetExpression(created.ID); !found {
+		t.Error("expression not found in its own store")
+	}
+	if list := second.store.ListExpressions(); len(list) != 0 {
+		t.Errorf("expected second store to stay empty, got %d expressions", len(list))
+	}
+}
+
+func TestHandleCalculate_ParseError(t *testing.T) {
+	rec := postCalculate(t, New(store.New()), `{"expression": "1 + * 2"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rec.Code)
+	}
+	var response ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != "unexpected_token" || response.Position != 4 || response.Token != "*" {
+		t.Errorf("unexpected error response: %+v", response)
+	}
+}
+
+func TestHandleCalculate_UnboundVariable(t *testing.T) {
+	rec := postCalculate(t, New(store.New()), `{"expression": "x+y", "variables": {"x": 1}}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rec.Code)
+	}
+	var response ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != "unbound_variable" || response.Variable != "y" || response.Token != "y" {
+		t.Errorf("unexpected error response: %+v", response)
+	}
+}
+
+func TestHandlePostTaskResult_Error(t *testing.T) {
+	h := New(store.New())
+	rec := postCalculate(t, h, `{"expression": "1/(2-2)"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var created CalculateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	task, ok := h.store.GetReadyTask("")
+	if !ok {
+		t.Fatal("no ready task")
+	}
+	body := `{"id": "` + task.ID + `", "error": "division by zero"}`
+	req := httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body))
+	rec = httptest.NewRecorder()
+	h.TaskHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+created.ID, nil)
+	rec = httptest.NewRecorder()
+	h.HandleExpressionByID(rec, req)
+	var detail ExpressionDetailResponse
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Expression.Status != "error" || detail.Expression.Error != "division by zero" {
+		t.Errorf("unexpected expression: %+v", detail.Expression)
+	}
+}
+
+func TestHandleAgents(t *testing.T) {
+	h := New(store.New())
+	body := `{"hostname": "worker-1", "computing_power": 3, "operators": ["+", "-"], "version": "1.0"}`
+	req := httptest.NewRequest(http.MethodPost, "/internal/agents", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.HandleRegisterAgent(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	var registered RegisterAgentResponse
+	if err := json.NewDecoder(rec.Body).Decode(&registered); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/internal/agents/"+registered.ID+"/heartbeat", nil)
+	rec = httptest.NewRecorder()
+	h.HandleAgentHeartbeat(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/internal/agents/agent-unknown/heartbeat", nil)
+	rec = httptest.NewRecorder()
+	h.HandleAgentHeartbeat(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown agent, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/agents", nil)
+	rec = httptest.NewRecorder()
+	h.HandleAgents(rec, req)
+	var response AgentsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Agents) != 1 || response.Agents[0].ID != registered.ID || !response.Agents[0].Alive {
+		t.Errorf("unexpected agents: %+v", response.Agents)
+	}
+}
+
+func TestTaskHandler_Batch(t *testing.T) {
+	h := New(store.New())
+	rec := postCalculate(t, h, `{"expression": "1+2+3+4"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/internal/task?limit=5", nil)
+	rec = httptest.NewRecorder()
+	h.TaskHandler(rec, req)
+	var batch TaskBatchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&batch); err != nil {
+		t.Fatal(err)
+	}
+	// After rebalancing (1+2)+(3+4) has two independent tasks
+	if len(batch.Tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(batch.Tasks))
+	}
+
+	body := `[{"id": "` + batch.Tasks[0].ID + `", "result": 3}, {"id": "` + batch.Tasks[1].ID + `", "result": 7}, {"id": "task-unknown", "result": 0}]`
+	req = httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body))
+	rec = httptest.NewRecorder()
+	h.TaskHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var results TaskBatchResultResponse
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results.NotFound) != 1 || results.NotFound[0] != "task-unknown" {
+		t.Errorf("unexpected not_found: %v", results.NotFound)
+	}
+
+	root, ok := h.store.GetReadyTask("")
+	if !ok || root.Args[0] != "3" || root.Args[1] != "7" {
+		t.Errorf("expected the root task with both results, got %+v", root)
+	}
+}
+
+func TestHandleExpressionByID_Cancel(t *testing.T) {
+	h := New(store.New())
+	rec := postCalculate(t, h, `{"expression": "(1+2)*3"}`)
+	var created CalculateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	task, ok := h.store.GetReadyTask("")
+	if !ok {
+		t.Fatal("no ready task")
+	}
+
+	cancel := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/expressions/"+created.ID, nil)
+		rec := httptest.NewRecorder()
+		h.HandleExpressionByID(rec, req)
+		return rec
+	}
+	rec = cancel()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var detail ExpressionDetailResponse
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Expression.Status != "cancelled" {
+		t.Errorf("expected cancelled, got %s", detail.Expression.Status)
+	}
+
+	// A result that arrives after cancellation is accepted but discarded
+	body := `{"id": "` + task.ID + `", "result": 3}`
+	req := httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body))
+	rec = httptest.NewRecorder()
+	h.TaskHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if task, ok := h.store.GetReadyTask(""); ok {
+		t.Errorf("task %s of a cancelled expression was dispatched", task.ID)
+	}
+	if expr, _ := h.store.GetExpression(created.ID); expr.Status != "cancelled" {
+		t.Errorf("expected cancelled, got %s", expr.Status)
+	}
+
+	if rec := cancel(); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a finished expression, got %d", rec.Code)
+	}
+}
@@ -1,41 +1,124 @@
 package handler
 
 import (
+	"bytes"
 	"calc-service/internal/store"
 	"calc-service/pkg/logger"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type TaskResponse struct {
 	Task *store.Task `json:"task"`
+	// LeaseMs is how long the agent may hold the task without a heartbeat
+	LeaseMs int64 `json:"lease_ms"`
+}
+
+// TaskBatchResponse is returned instead of TaskResponse when the agent asks for several tasks
+type TaskBatchResponse struct {
+	Tasks   []*store.Task `json:"tasks"`
+	LeaseMs int64         `json:"lease_ms"`
 }
 
 type TaskResultRequest struct {
 	ID     string  `json:"id"`
 	Result float64 `json:"result"`
+	// Error is set when the operation failed (e.g. division by zero);
+	// the whole expression then fails with this reason
+	Error string `json:"error,omitempty"`
+}
+
+// TaskBatchResultResponse lists the results of a batch that referred to unknown tasks
+type TaskBatchResultResponse struct {
+	NotFound []string `json:"not_found,omitempty"`
 }
 
-func TaskHandler(w http.ResponseWriter, r *http.Request) {
+type TaskHeartbeatRequest struct {
+	ID           string `json:"id"`
+	Redispatches int    `json:"redispatches"`
+}
+
+func (h *Handler) TaskHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleGetTask(w, r)
+		h.handleGetTask(w, r)
 	case http.MethodPost:
-		handlePostTaskResult(w, r)
+		h.handlePostTaskResult(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleGetTask(w http.ResponseWriter, r *http.Request) {
-	task, found := store.GetReadyTask()
-	if !found {
+// maxTaskWait caps the wait parameter of GET /internal/task
+const maxTaskWait = time.Minute
+
+// maxTaskBatch caps the limit parameter of GET /internal/task
+const maxTaskBatch = 100
+
+// handleGetTask hands out a ready task. With ?wait=<duration> (e.g. 30s) the
+// request blocks until a task is ready or the duration passes, so idle agents
+// get new work as soon as it appears instead of polling. A registered agent
+// passes its ID in ?agent_id= so the task is attributed to it. With
+// ?limit=N up to N tasks are returned at once as a TaskBatchResponse.
+func (h *Handler) handleGetTask(w http.ResponseWriter, r *http.Request) {
+	agentID := r.URL.Query().Get("agent_id")
+	if agentID != "" {
+		if err := h.store.TouchAgent(agentID); err != nil {
+			logger.Debug("Task requested by unregistered agent: %v", err)
+		}
+	}
+
+	var wait time.Duration
+	if param := r.URL.Query().Get("wait"); param != "" {
+		d, err := time.ParseDuration(param)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxTaskWait)
+	}
+
+	limit := 1
+	param := r.URL.Query().Get("limit")
+	batch := param != ""
+	if batch {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxTaskBatch)
+	}
+
+	var tasks []*store.Task
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		tasks = h.store.WaitReadyTasks(ctx, agentID, limit)
+		cancel()
+	} else {
+		tasks = h.store.GetReadyTasks(agentID, limit)
+	}
+	if len(tasks) == 0 {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	response := TaskResponse{Task: task}
+	var response any = TaskResponse{
+		Task:    tasks[0],
+		LeaseMs: store.LeaseDuration().Milliseconds(),
+	}
+	if batch {
+		response = TaskBatchResponse{
+			Tasks:   tasks,
+			LeaseMs: store.LeaseDuration().Milliseconds(),
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -45,20 +128,32 @@ func handleGetTask(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
+// handlePostTaskResult accepts a single result or a JSON array of results.
+// Unknown tasks in an array are skipped and listed in the response.
+func (h *Handler) handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		return
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		h.handlePostTaskResults(w, trimmed)
+		return
+	}
+
 	var req TaskResultRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		logger.Error("Failed to decode task result: %v", err)
 		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
 		return
 	}
 
-	if _, exists := store.GetTask(req.ID); !exists {
+	if _, exists := h.store.GetTask(req.ID); !exists {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
 
-	if err := store.CompleteTask(req.ID, req.Result); err != nil {
+	if err := reportTaskResult(h.store, req.ID, req.Result, req.Error); err != nil {
 		logger.Error("Failed to complete task: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -67,14 +162,78 @@ func handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func HandleTaskByID(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handlePostTaskResults(w http.ResponseWriter, body []byte) {
+	var reqs []TaskResultRequest
+	if err := json.Unmarshal(body, &reqs); err != nil {
+		logger.Error("Failed to decode task results: %v", err)
+		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var response TaskBatchResultResponse
+	for _, req := range reqs {
+		if _, exists := h.store.GetTask(req.ID); !exists {
+			response.NotFound = append(response.NotFound, req.ID)
+			continue
+		}
+		if err := reportTaskResult(h.store, req.ID, req.Result, req.Error); err != nil {
+			logger.Error("Failed to complete task: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// reportTaskResult completes a task or, if the agent reported an error, fails its expression.
+// Results that arrive for tasks of a cancelled expression are dropped by the store.
+func reportTaskResult(st *store.Store, id string, result float64, errMsg string) error {
+	if errMsg != "" {
+		logger.Info("Task %s failed: %s", id, errMsg)
+		return st.FailTask(id, errMsg)
+	}
+	return st.CompleteTask(id, result)
+}
+
+// HandleTaskHeartbeat renews the lease of a task the agent is still working on.
+// 409 Conflict tells the agent the task has been handed to someone else.
+func (h *Handler) HandleTaskHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TaskHeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		return
+	}
+
+	err := h.store.RenewLease(req.ID, req.Redispatches)
+	switch {
+	case errors.Is(err, store.ErrTaskNotFound):
+		http.Error(w, "Task not found", http.StatusNotFound)
+	case errors.Is(err, store.ErrLeaseLost):
+		http.Error(w, "Task lease lost", http.StatusConflict)
+	case err != nil:
+		logger.Error("Failed to renew lease: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h *Handler) HandleTaskByID(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	id := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/")
-	task, exists := store.GetTask(id)
+	task, exists := h.store.GetTask(id)
 	if !exists {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
@@ -0,0 +1,96 @@
+package operations
+
+import (
+	"fmt"
+	"math"
+)
+
+// Operators перечисляет операции, которые умеет вычислять Apply
+var Operators = []string{"+", "-", "neg", "*", "/", "^", "sqrt", "abs", "pow", "log", "min", "max"}
+
+// Apply вычисляет операцию operator над аргументами args.
+// Используется агентом для выполнения задач и оркестратором для свёртки констант.
+// Бесконечность и NaN (например, 10^400) считаются ошибкой: их нельзя
+// передать в JSON, а выражение с ними всё равно не имеет смысла.
+func Apply(operator string, args []float64) (float64, error) {
+	result, err := apply(operator, args)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, fmt.Errorf("result out of range")
+	}
+	return result, nil
+}
+
+func apply(operator string, args []float64) (float64, error) {
+	switch operator {
+	case "+", "-", "*", "/", "^":
+		if len(args) != 2 {
+			return 0, fmt.Errorf("operator %s expects 2 arguments, got %d", operator, len(args))
+		}
+	case "neg", "sqrt", "abs":
+		if len(args) != 1 {
+			return 0, fmt.Errorf("operator %s expects 1 argument, got %d", operator, len(args))
+		}
+	}
+
+	switch operator {
+	case "+":
+		return args[0] + args[1], nil
+	case "-":
+		return args[0] - args[1], nil
+	case "neg":
+		return -args[0], nil
+	case "*":
+		return args[0] * args[1], nil
+	case "/":
+		if args[1] == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return args[0] / args[1], nil
+	case "^":
+		return math.Pow(args[0], args[1]), nil
+	case "sqrt":
+		if args[0] < 0 {
+			return 0, fmt.Errorf("square root of negative number")
+		}
+		return math.Sqrt(args[0]), nil
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "pow":
+		if len(args) != 2 {
+			return 0, fmt.Errorf("pow expects 2 arguments, got %d", len(args))
+		}
+		return math.Pow(args[0], args[1]), nil
+	case "log":
+		if len(args) < 1 || len(args) > 2 {
+			return 0, fmt.Errorf("log expects 1 or 2 arguments, got %d", len(args))
+		}
+		if args[0] <= 0 {
+			return 0, fmt.Errorf("logarithm of non-positive number")
+		}
+		if len(args) == 1 {
+			return math.Log(args[0]), nil
+		}
+		if args[1] <= 0 || args[1] == 1 {
+			return 0, fmt.Errorf("invalid logarithm base")
+		}
+		return math.Log(args[0]) / math.Log(args[1]), nil
+	case "min", "max":
+		if len(args) == 0 {
+			return 0, fmt.Errorf("%s expects at least 1 argument", operator)
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			if operator == "min" {
+				result = math.Min(result, arg)
+			} else {
+				result = math.Max(result, arg)
+			}
+		}
+		return result, nil
+	default:
+		return 0, fmt.Errorf("unknown operator: %s", operator)
+	}
+}
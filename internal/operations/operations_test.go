@@ -0,0 +1,71 @@
+package operations
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	cases := []struct {
+		operator string
+		args     []float64
+		want     float64
+	}{
+		{"+", []float64{2, 3}, 5},
+		{"-", []float64{2, 3}, -1},
+		{"neg", []float64{2}, -2},
+		{"*", []float64{2, 3}, 6},
+		{"/", []float64{3, 2}, 1.5},
+		{"^", []float64{2, 10}, 1024},
+		{"sqrt", []float64{16}, 4},
+		{"abs", []float64{-7}, 7},
+		{"pow", []float64{3, 2}, 9},
+		{"log", []float64{8, 2}, 3},
+		{"min", []float64{3, -1, 2}, -1},
+		{"max", []float64{3, -1, 2}, 3},
+	}
+	for _, c := range cases {
+		got, err := Apply(c.operator, c.args)
+		if err != nil {
+			t.Errorf("%s%v: unexpected error: %v", c.operator, c.args, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s%v: expected %v, got %v", c.operator, c.args, c.want, got)
+		}
+	}
+}
+
+func TestApply_Errors(t *testing.T) {
+	cases := []struct {
+		operator string
+		args     []float64
+	}{
+		{"/", []float64{1, 0}},
+		{"sqrt", []float64{-1}},
+		{"log", []float64{0}},
+		{"log", []float64{8, 1}},
+		{"+", []float64{1}},
+		{"max", nil},
+		{"%", []float64{1, 2}},
+		// Переполнение и NaN
+		{"^", []float64{10, 400}},
+		{"pow", []float64{-8, 0.5}},
+		{"*", []float64{1e308, 10}},
+		{"-", []float64{math.Inf(1), math.Inf(1)}},
+	}
+	for _, c := range cases {
+		if _, err := Apply(c.operator, c.args); err == nil {
+			t.Errorf("%s%v: expected error", c.operator, c.args)
+		}
+	}
+}
+
+func TestOperatorsAreSupported(t *testing.T) {
+	for _, op := range Operators {
+		if _, err := Apply(op, []float64{4, 2}); err != nil && strings.Contains(err.Error(), "unknown operator") {
+			t.Errorf("оператор %s объявлен, но не поддерживается", op)
+		}
+	}
+}
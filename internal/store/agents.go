@@ -0,0 +1,114 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrAgentNotFound is returned for an agent ID the orchestrator does not know,
+// e.g. after it was restarted; the agent should register again
+var ErrAgentNotFound = errors.New("agent not found")
+
+// Default interval between agent heartbeats
+const defaultAgentHeartbeat = 5 * time.Second
+
+// An agent that missed this many heartbeats in a row is reported as dead
+const missedHeartbeats = 3
+
+// AgentHeartbeat returns the agent heartbeat interval taken from AGENT_HEARTBEAT_MS
+func AgentHeartbeat() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("AGENT_HEARTBEAT_MS"))
+	if err != nil || ms <= 0 {
+		return defaultAgentHeartbeat
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Agent is a registered agent process
+type Agent struct {
+	ID             string    `json:"id"`
+	Hostname       string    `json:"hostname"`
+	ComputingPower int       `json:"computing_power"`
+	Operators      []string  `json:"operators"`
+	Version        string    `json:"version"`
+	RegisteredAt   time.Time `json:"registered_at"`
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+// AgentStatus is an agent together with its liveness and the tasks it holds
+type AgentStatus struct {
+	Agent
+	Alive bool     `json:"alive"`
+	Tasks []string `json:"tasks"`
+}
+
+// RegisterAgent assigns an ID to the agent and starts tracking its heartbeats
+func (s *Store) RegisterAgent(agent Agent) *Agent {
+	s.agentMutex.Lock()
+	defer s.agentMutex.Unlock()
+
+	now := time.Now()
+	registered := agent
+	registered.ID = fmt.Sprintf("agent-%d", now.UnixNano())
+	for s.agents[registered.ID] != nil {
+		registered.ID = fmt.Sprintf("agent-%d", time.Now().UnixNano())
+	}
+	registered.RegisteredAt = now
+	registered.LastSeen = now
+
+	s.agents[registered.ID] = &registered
+	snapshot := registered
+	return &snapshot
+}
+
+// TouchAgent records a sign of life from the agent
+func (s *Store) TouchAgent(agentID string) error {
+	s.agentMutex.Lock()
+	defer s.agentMutex.Unlock()
+
+	agent, found := s.agents[agentID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrAgentNotFound, agentID)
+	}
+	agent.LastSeen = time.Now()
+	return nil
+}
+
+// ListAgents returns all registered agents ordered by registration time. An
+// agent is alive if it was seen within missedHeartbeats heartbeat intervals.
+func (s *Store) ListAgents(now time.Time) []AgentStatus {
+	s.agentMutex.Lock()
+	result := make([]AgentStatus, 0, len(s.agents))
+	for _, agent := range s.agents {
+		result = append(result, AgentStatus{
+			Agent: *agent,
+			Alive: now.Sub(agent.LastSeen) <= missedHeartbeats*AgentHeartbeat(),
+			Tasks: []string{},
+		})
+	}
+	s.agentMutex.Unlock()
+
+	s.taskMutex.Lock()
+	held := make(map[string][]string)
+	for _, task := range s.inFlight {
+		if task.AgentID != "" {
+			held[task.AgentID] = append(held[task.AgentID], task.ID)
+		}
+	}
+	s.taskMutex.Unlock()
+
+	for i := range result {
+		if tasks, ok := held[result[i].ID]; ok {
+			sort.Strings(tasks)
+			result[i].Tasks = tasks
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].RegisteredAt.Before(result[j].RegisteredAt)
+	})
+	return result
+}
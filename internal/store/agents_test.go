@@ -0,0 +1,48 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegisterAgent(t *testing.T) {
+	s := New()
+	first := s.RegisterAgent(Agent{Hostname: "host-1", ComputingPower: 2})
+	second := s.RegisterAgent(Agent{Hostname: "host-2", ComputingPower: 4})
+
+	if first.ID == "" || first.ID == second.ID {
+		t.Fatalf("ожидались разные ID агентов, получено %q и %q", first.ID, second.ID)
+	}
+	if err := s.TouchAgent(first.ID); err != nil {
+		t.Errorf("ошибка heartbeat: %v", err)
+	}
+	if err := s.TouchAgent("agent-unknown"); !errors.Is(err, ErrAgentNotFound) {
+		t.Errorf("ожидалась ErrAgentNotFound, получено %v", err)
+	}
+}
+
+func TestListAgents(t *testing.T) {
+	s := New()
+	agent := s.RegisterAgent(Agent{Hostname: "host-1", ComputingPower: 1})
+	expr := s.NewExpression("1 + 1", nil)
+	task := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "1"}, Operator: "+"}
+	s.RegisterTasks(expr.ID, []*Task{task})
+	if _, ok := s.GetReadyTask(agent.ID); !ok {
+		t.Fatal("задача не выдана")
+	}
+
+	agents := s.ListAgents(time.Now())
+	if len(agents) != 1 || !agents[0].Alive || agents[0].Hostname != "host-1" {
+		t.Fatalf("ожидался один живой агент, получено %+v", agents)
+	}
+	if len(agents[0].Tasks) != 1 || agents[0].Tasks[0] != "task-1" {
+		t.Errorf("ожидалась задача task-1, получено %v", agents[0].Tasks)
+	}
+
+	// Агент, пропустивший несколько heartbeat подряд, считается мёртвым
+	later := time.Now().Add(missedHeartbeats*AgentHeartbeat() + time.Second)
+	if agents := s.ListAgents(later); agents[0].Alive {
+		t.Errorf("агент должен считаться мёртвым")
+	}
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"calc-service/pkg/logger"
+	"fmt"
+	"time"
+)
+
+// Backend persists expressions and tasks so they survive an orchestrator restart.
+// The in-memory maps stay the source of truth while running; the backend is
+// written through on every change and read once on startup.
+type Backend interface {
+	SaveExpression(expr *Expression) error
+	// SaveTasks stores the task list of an expression, preserving its order
+	SaveTasks(exprID string, tasks []*Task) error
+	Load() ([]*Expression, map[string][]*Task, error)
+	Close() error
+}
+
+// memoryBackend keeps nothing beyond the in-memory maps
+type memoryBackend struct{}
+
+func (memoryBackend) SaveExpression(*Expression) error { return nil }
+
+func (memoryBackend) SaveTasks(string, []*Task) error { return nil }
+
+func (memoryBackend) Load() ([]*Expression, map[string][]*Task, error) { return nil, nil, nil }
+
+func (memoryBackend) Close() error { return nil }
+
+// NewBackend creates a backend by name: "memory" (default) or "bolt",
+// which keeps data in the BoltDB file at path
+func NewBackend(kind, path string) (Backend, error) {
+	switch kind {
+	case "", "memory":
+		return memoryBackend{}, nil
+	case "bolt":
+		return NewBoltBackend(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", kind)
+	}
+}
+
+// Open creates a store that writes through to b and loads the expressions
+// saved there by a previous run. Tasks that were in progress when the
+// orchestrator stopped are handed out again.
+func Open(b Backend) (*Store, error) {
+	loadedExpressions, loadedTasks, err := b.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load storage: %w", err)
+	}
+
+	s := New()
+	s.backend = b
+	for _, expr := range loadedExpressions {
+		s.expressions[expr.ID] = expr
+		if expr.Status == "pending" && !expr.Deadline.IsZero() {
+			s.deadlines[expr.ID] = expr
+		}
+	}
+	for exprID, taskList := range loadedTasks {
+		s.exprTasks[exprID] = taskList
+		for _, task := range taskList {
+			// The ready queue is rebuilt below
+			task.Ready = false
+			if task.InProgress {
+				task.InProgress = false
+				task.LeaseExpiresAt = time.Time{}
+				task.Redispatches++
+			}
+			s.tasks[task.ID] = task
+		}
+	}
+
+	pending := 0
+	for _, expr := range loadedExpressions {
+		if expr.Status == "pending" {
+			s.linkTasks(s.exprTasks[expr.ID])
+			pending++
+		}
+	}
+	logger.Info("Storage loaded: %d expressions, %d pending", len(loadedExpressions), pending)
+	return s, nil
+}
+
+// Close flushes and closes the backend of the store
+func (s *Store) Close() error {
+	return s.backend.Close()
+}
+
+func (s *Store) saveExpression(expr *Expression) {
+	if err := s.backend.SaveExpression(expr); err != nil {
+		logger.Error("Failed to persist expression %s: %v", expr.ID, err)
+	}
+}
+
+func (s *Store) saveTasks(exprID string, taskList []*Task) {
+	if err := s.backend.SaveTasks(exprID, taskList); err != nil {
+		logger.Error("Failed to persist tasks of expression %s: %v", exprID, err)
+	}
+}
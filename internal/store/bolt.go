@@ -0,0 +1,95 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	expressionsBucket = []byte("expressions")
+	tasksBucket       = []byte("tasks")
+)
+
+// BoltBackend stores expressions and their task lists as JSON in a BoltDB file
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+// NewBoltBackend opens (or creates) the database file at path
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{expressionsBucket, tasksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create buckets: %w", err)
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+func (b *BoltBackend) SaveExpression(expr *Expression) error {
+	data, err := json.Marshal(expr)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(expressionsBucket).Put([]byte(expr.ID), data)
+	})
+}
+
+func (b *BoltBackend) SaveTasks(exprID string, taskList []*Task) error {
+	data, err := json.Marshal(taskList)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).Put([]byte(exprID), data)
+	})
+}
+
+func (b *BoltBackend) Load() ([]*Expression, map[string][]*Task, error) {
+	var loadedExpressions []*Expression
+	loadedTasks := make(map[string][]*Task)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(expressionsBucket).ForEach(func(k, v []byte) error {
+			var expr Expression
+			if err := json.Unmarshal(v, &expr); err != nil {
+				return fmt.Errorf("expression %s: %w", k, err)
+			}
+			loadedExpressions = append(loadedExpressions, &expr)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			var taskList []*Task
+			if err := json.Unmarshal(v, &taskList); err != nil {
+				return fmt.Errorf("tasks of %s: %w", k, err)
+			}
+			loadedTasks[string(k)] = taskList
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return loadedExpressions, loadedTasks, nil
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltBackendRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc.db")
+	b, err := NewBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expr := &Expression{ID: "expr-bolt-1", Expression: "1+2*3", Status: "pending"}
+	taskList := []*Task{
+		{ID: "task-bolt-1", ExpressionID: expr.ID, Args: []string{"2", "3"}, Operator: "*", Completed: true, Result: 6},
+		{ID: "task-bolt-2", ExpressionID: expr.ID, Args: []string{"1", "task:task-bolt-1"}, Operator: "+", InProgress: true},
+	}
+	if err := b.SaveExpression(expr); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SaveTasks(expr.ID, taskList); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// Повторное открытие файла имитирует перезапуск оркестратора
+	b, err = NewBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	res, found := s.GetExpression(expr.ID)
+	if !found || res.Expression != "1+2*3" || res.Status != "pending" {
+		t.Fatalf("выражение не восстановлено: %+v", res)
+	}
+	root, found := s.GetTask("task-bolt-2")
+	if !found {
+		t.Fatal("задача не восстановлена")
+	}
+	if root.InProgress || !root.Ready {
+		t.Errorf("незавершённая задача должна снова стать готовой: %+v", root)
+	}
+
+	if err := s.CompleteTask(root.ID, 7); err != nil {
+		t.Fatal(err)
+	}
+	_, loadedTasks, err := b.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved := loadedTasks[expr.ID]; len(saved) != 2 || !saved[1].Completed || saved[1].Result != 7 {
+		t.Errorf("результат задачи не сохранён: %+v", saved)
+	}
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrExpressionNotFound is returned for an unknown expression ID
+	ErrExpressionNotFound = errors.New("expression not found")
+	// ErrExpressionFinished is returned when cancelling an expression that is no longer pending
+	ErrExpressionFinished = errors.New("expression already finished")
+)
+
+// CancelExpression stops a pending expression: its tasks are no longer handed
+// out, and results that agents report later for them are dropped
+func (s *Store) CancelExpression(id string) error {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
+
+	expr, found := s.expressions[id]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrExpressionNotFound, id)
+	}
+	if expr.Status != "pending" {
+		return fmt.Errorf("%w: %s is %s", ErrExpressionFinished, id, expr.Status)
+	}
+
+	s.cancelTasks(id)
+	expr.Status = "cancelled"
+	s.saveExpression(expr)
+	s.publishFinished(expr)
+	return nil
+}
+
+// cancelTasks marks every unfinished task of the expression as cancelled.
+// Cancelled tasks stay in the ready queue until it skips them. Requires taskMutex.
+func (s *Store) cancelTasks(exprID string) {
+	taskList := s.exprTasks[exprID]
+	for _, t := range taskList {
+		if !t.Completed {
+			t.Cancelled = true
+			t.Ready = false
+			t.InProgress = false
+			t.LeaseExpiresAt = time.Time{}
+		}
+		delete(s.dependents, t.ID)
+		delete(s.inFlight, t.ID)
+	}
+	s.saveTasks(exprID, taskList)
+}
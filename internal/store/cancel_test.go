@@ -0,0 +1,69 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCancelExpression(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1+2+3*4", nil)
+	sum := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "2"}, Operator: "+"}
+	mul := &Task{ID: "task-2", ExpressionID: expr.ID, Args: []string{"3", "4"}, Operator: "*"}
+	root := &Task{ID: "task-3", ExpressionID: expr.ID, Args: []string{"task:task-1", "task:task-2"}, Operator: "+"}
+
+	s.RegisterTasks(expr.ID, []*Task{sum, mul, root})
+	if _, ok := s.GetReadyTask(""); !ok {
+		t.Fatal("задача не выдана")
+	}
+
+	if err := s.CancelExpression(expr.ID); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := s.GetExpression(expr.ID); res.Status != "cancelled" {
+		t.Errorf("ожидался статус cancelled, получено %s", res.Status)
+	}
+	if task, ok := s.GetReadyTask(""); ok {
+		t.Errorf("задача %s отменённого выражения выдана агенту", task.ID)
+	}
+	// Результат, пришедший после отмены, отбрасывается
+	if err := s.CompleteTask(sum.ID, 3); err != nil || sum.Completed {
+		t.Errorf("результат отменённой задачи принят")
+	}
+	if res, _ := s.GetExpression(expr.ID); res.Status != "cancelled" {
+		t.Errorf("ожидался статус cancelled, получено %s", res.Status)
+	}
+
+	if err := s.CancelExpression(expr.ID); !errors.Is(err, ErrExpressionFinished) {
+		t.Errorf("ожидалась ErrExpressionFinished, получено %v", err)
+	}
+	if err := s.CancelExpression("expr-unknown"); !errors.Is(err, ErrExpressionNotFound) {
+		t.Errorf("ожидалась ErrExpressionNotFound, получено %v", err)
+	}
+}
+
+func TestCancelBeforeTasksRegistered(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1+2", nil)
+
+	// Выражение уже видно клиенту, а задачи ещё не зарегистрированы
+	if err := s.CancelExpression(expr.ID); err != nil {
+		t.Fatal(err)
+	}
+	task := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "2"}, Operator: "+"}
+	s.RegisterTasks(expr.ID, []*Task{task})
+
+	if got, ok := s.GetReadyTask(""); ok {
+		t.Fatalf("задача %s отменённого выражения выдана агенту", got.ID)
+	}
+	if !task.Cancelled {
+		t.Errorf("задача отменённого выражения не отменена")
+	}
+	if err := s.CompleteTask(task.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	s.CompleteExpression(expr.ID, 3)
+	if res, _ := s.GetExpression(expr.ID); res.Status != "cancelled" {
+		t.Errorf("ожидался статус cancelled, получено %s", res.Status)
+	}
+}
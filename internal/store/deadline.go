@@ -0,0 +1,78 @@
+package store
+
+import "time"
+
+// SetDeadline sets the time by which the expression must be evaluated
+func (s *Store) SetDeadline(exprID string, deadline time.Time) {
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
+
+	if expr, found := s.expressions[exprID]; found {
+		expr.Deadline = deadline
+		s.saveExpression(expr)
+		if expr.Status == "pending" {
+			s.deadlines[exprID] = expr
+		}
+	}
+}
+
+// ExpireExpressions moves pending expressions whose deadline passed before now
+// to the timeout status and cancels their tasks. It returns the expired IDs.
+// Only expressions with a deadline are checked, and taskMutex is taken only
+// when one of them is overdue.
+func (s *Store) ExpireExpressions(now time.Time) []string {
+	s.exprMutex.Lock()
+	var overdue []string
+	for id, expr := range s.deadlines {
+		switch {
+		case expr.Status != "pending":
+			// Finished in time, cancelled or failed
+			delete(s.deadlines, id)
+		case !now.Before(expr.Deadline):
+			overdue = append(overdue, id)
+		}
+	}
+	s.exprMutex.Unlock()
+	if len(overdue) == 0 {
+		return nil
+	}
+
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
+
+	var expired []string
+	for _, id := range overdue {
+		// The expression may have finished while no lock was held
+		if expr, found := s.expressions[id]; found && s.expireIfOverdue(expr, now) {
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// expireIfOverdue times out a pending expression past its deadline.
+// Requires taskMutex and exprMutex.
+func (s *Store) expireIfOverdue(expr *Expression, now time.Time) bool {
+	if expr.Status != "pending" || expr.Deadline.IsZero() || now.Before(expr.Deadline) {
+		return false
+	}
+	s.cancelTasks(expr.ID)
+	delete(s.deadlines, expr.ID)
+	expr.Status = "timeout"
+	s.saveExpression(expr)
+	s.publishFinished(expr)
+	return true
+}
+
+// overdue reports whether the task belongs to an expression that is no longer
+// pending or has just run out of time; in the latter case the expression is
+// timed out on the spot. Requires taskMutex.
+func (s *Store) overdue(task *Task, now time.Time) bool {
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
+
+	expr, found := s.expressions[task.ExpressionID]
+	return found && (expr.Status != "pending" || s.expireIfOverdue(expr, now))
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireExpressions(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1+2", nil)
+	task := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "2"}, Operator: "+"}
+	s.RegisterTasks(expr.ID, []*Task{task})
+	deadline := time.Now().Add(time.Minute)
+	s.SetDeadline(expr.ID, deadline)
+
+	if expired := s.ExpireExpressions(deadline.Add(-time.Second)); len(expired) != 0 {
+		t.Errorf("выражение просрочено до дедлайна: %v", expired)
+	}
+	if _, ok := s.GetReadyTask(""); !ok {
+		t.Fatal("задача не выдана")
+	}
+
+	expired := s.ExpireExpressions(deadline)
+	if len(expired) != 1 || expired[0] != expr.ID {
+		t.Fatalf("ожидалось просроченное выражение %s, получено %v", expr.ID, expired)
+	}
+	if res, _ := s.GetExpression(expr.ID); res.Status != "timeout" {
+		t.Errorf("ожидался статус timeout, получено %s", res.Status)
+	}
+	// Результат, пришедший после дедлайна, отбрасывается
+	if err := s.CompleteTask(task.ID, 3); err != nil || task.Completed {
+		t.Errorf("результат просроченной задачи принят")
+	}
+}
+
+func TestDequeueSkipsOverdueExpression(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1+2", nil)
+	s.RegisterTasks(expr.ID, []*Task{{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "2"}, Operator: "+"}})
+	s.SetDeadline(expr.ID, time.Now().Add(-time.Millisecond))
+
+	if task, ok := s.GetReadyTask(""); ok {
+		t.Errorf("выдана задача просроченного выражения %s", task.ID)
+	}
+	if res, _ := s.GetExpression(expr.ID); res.Status != "timeout" {
+		t.Errorf("ожидался статус timeout, получено %s", res.Status)
+	}
+}
+
+func TestExpireExpressionsChecksOnlyPendingDeadlines(t *testing.T) {
+	s := New()
+	done := s.NewExpression("1+2", nil)
+	s.RegisterTasks(done.ID, []*Task{{ID: "task-1", ExpressionID: done.ID, Args: []string{"1", "2"}, Operator: "+"}})
+	s.SetDeadline(done.ID, time.Now().Add(time.Minute))
+	s.NewExpression("3+4", nil)
+
+	if len(s.deadlines) != 1 {
+		t.Fatalf("ожидалось одно выражение с дедлайном, получено %d", len(s.deadlines))
+	}
+	if err := s.CompleteTask("task-1", 3); err != nil {
+		t.Fatal(err)
+	}
+	if expired := s.ExpireExpressions(time.Now().Add(time.Hour)); len(expired) != 0 {
+		t.Errorf("просрочено завершённое выражение: %v", expired)
+	}
+	if len(s.deadlines) != 0 {
+		t.Errorf("завершённое выражение осталось среди отслеживаемых")
+	}
+	if res, _ := s.GetExpression(done.ID); res.Status != "done" {
+		t.Errorf("ожидался статус done, получено %s", res.Status)
+	}
+}
+
+func TestDequeueSkipsFinishedExpression(t *testing.T) {
+	s := New()
+	expired := s.NewExpression("1+2", nil)
+	s.SetDeadline(expired.ID, time.Now().Add(-time.Millisecond))
+	if ids := s.ExpireExpressions(time.Now()); len(ids) != 1 {
+		t.Fatalf("ожидалось одно просроченное выражение, получено %v", ids)
+	}
+	// Задачи зарегистрированы уже после дедлайна
+	s.RegisterTasks(expired.ID, []*Task{{ID: "task-1", ExpressionID: expired.ID, Args: []string{"1", "2"}, Operator: "+"}})
+
+	// Задача осталась в очереди, хотя выражение уже завершено
+	done := s.NewExpression("3+4", nil)
+	s.RegisterTasks(done.ID, []*Task{{ID: "task-2", ExpressionID: done.ID, Args: []string{"3", "4"}, Operator: "+"}})
+	s.CompleteExpression(done.ID, 7)
+
+	if task, ok := s.GetReadyTask(""); ok {
+		t.Errorf("задача %s завершённого выражения выдана агенту", task.ID)
+	}
+	if res, _ := s.GetExpression(expired.ID); res.Status != "timeout" {
+		t.Errorf("ожидался статус timeout, получено %s", res.Status)
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+// Event types published while an expression is evaluated
+const (
+	// EventDispatched: a task was handed out to an agent
+	EventDispatched = "dispatched"
+	// EventCompleted: an agent reported the result of a task
+	EventCompleted = "completed"
+	// EventFailed: an agent failed to evaluate a task
+	EventFailed = "failed"
+	// EventFinished: the expression left the pending status; it is the last event
+	EventFinished = "finished"
+)
+
+// Event is a step in the evaluation of an expression
+type Event struct {
+	Type      string   `json:"type"`
+	TaskID    string   `json:"task_id,omitempty"`
+	Operation string   `json:"operation,omitempty"`
+	AgentID   string   `json:"agent_id,omitempty"`
+	Result    *float64 `json:"result,omitempty"`
+	// Status is the final status of the expression in a finished event
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Events a subscriber may fall behind by before it is dropped
+const subscriberBuffer = 64
+
+// Subscribe returns the events of an expression as they happen and a function
+// that ends the subscription. The channel is closed after the finished event,
+// or early if the subscriber does not keep up.
+func (s *Store) Subscribe(exprID string) (<-chan Event, func()) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	if s.subscribers[exprID] == nil {
+		s.subscribers[exprID] = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, subscriberBuffer)
+	s.subscribers[exprID][ch] = struct{}{}
+
+	unsubscribe := func() {
+		s.eventMutex.Lock()
+		defer s.eventMutex.Unlock()
+		s.unsubscribe(exprID, ch)
+	}
+	return ch, unsubscribe
+}
+
+// publish delivers an event without blocking; it may be called with the
+// other store mutexes held
+func (s *Store) publish(exprID string, event Event) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	for ch := range s.subscribers[exprID] {
+		select {
+		case ch <- event:
+		default:
+			s.unsubscribe(exprID, ch)
+		}
+		if event.Type == EventFinished {
+			s.unsubscribe(exprID, ch)
+		}
+	}
+}
+
+// unsubscribe closes a subscriber channel once. Requires eventMutex.
+func (s *Store) unsubscribe(exprID string, ch chan Event) {
+	subs := s.subscribers[exprID]
+	if _, found := subs[ch]; !found {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(s.subscribers, exprID)
+	}
+}
+
+// publishFinished announces the final status of an expression. Requires exprMutex.
+func (s *Store) publishFinished(expr *Expression) {
+	event := Event{Type: EventFinished, Status: expr.Status, Error: expr.Error}
+	if expr.Status == "done" {
+		result := expr.Result
+		event.Result = &result
+	}
+	s.publish(expr.ID, event)
+}
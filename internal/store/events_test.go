@@ -0,0 +1,68 @@
+package store
+
+import "testing"
+
+func TestSubscribeReceivesProgress(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("(1+2)*3", nil)
+	sum := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "2"}, Operator: "+"}
+	mul := &Task{ID: "task-2", ExpressionID: expr.ID, Args: []string{"task:task-1", "3"}, Operator: "*"}
+	s.RegisterTasks(expr.ID, []*Task{sum, mul})
+
+	events, unsubscribe := s.Subscribe(expr.ID)
+	defer unsubscribe()
+
+	for _, step := range []struct {
+		id     string
+		result float64
+	}{{sum.ID, 3}, {mul.ID, 9}} {
+		task, ok := s.GetReadyTask("agent-1")
+		if !ok || task.ID != step.id {
+			t.Fatalf("ожидалась задача %s", step.id)
+		}
+		if err := s.CompleteTask(task.ID, step.result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for event := range events {
+		got = append(got, event.Type+" "+event.TaskID)
+		if event.Type == EventFinished && (event.Status != "done" || event.Result == nil || *event.Result != 9) {
+			t.Errorf("неверное финальное событие: %+v", event)
+		}
+	}
+	want := []string{"dispatched task-1", "completed task-1", "dispatched task-2", "completed task-2", "finished "}
+	if len(got) != len(want) {
+		t.Fatalf("ожидались события %v, получено %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("событие %d: ожидалось %q, получено %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSubscribeFailure(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1/0", nil)
+	div := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "0"}, Operator: "/"}
+	s.RegisterTasks(expr.ID, []*Task{div})
+
+	events, unsubscribe := s.Subscribe(expr.ID)
+	defer unsubscribe()
+	if err := s.FailTask(div.ID, "division by zero"); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, finished := <-events, <-events
+	if failed.Type != EventFailed || failed.Error != "division by zero" {
+		t.Errorf("неверное событие ошибки: %+v", failed)
+	}
+	if finished.Type != EventFinished || finished.Status != "error" {
+		t.Errorf("неверное финальное событие: %+v", finished)
+	}
+	if _, open := <-events; open {
+		t.Error("канал не закрыт после финального события")
+	}
+}
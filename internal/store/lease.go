@@ -0,0 +1,76 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrTaskNotFound is returned for an unknown task ID
+	ErrTaskNotFound = errors.New("task not found")
+	// ErrLeaseLost is returned when the caller no longer holds the task lease
+	ErrLeaseLost = errors.New("task lease lost")
+)
+
+// Default time an agent may hold a task without renewing the lease
+const defaultLeaseDuration = 10 * time.Second
+
+// LeaseDuration returns the task lease duration taken from TASK_LEASE_MS
+func LeaseDuration() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("TASK_LEASE_MS"))
+	if err != nil || ms <= 0 {
+		return defaultLeaseDuration
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// RenewLease extends the lease of an in-progress task. redispatches must match
+// the value the task had when it was handed out, so a holder whose lease has
+// already been reclaimed cannot renew the lease of the next one.
+func (s *Store) RenewLease(taskID string, redispatches int) error {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+
+	task, exists := s.tasks[taskID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+	if !task.InProgress || task.Redispatches != redispatches {
+		return fmt.Errorf("%w: %s", ErrLeaseLost, taskID)
+	}
+
+	task.LeaseExpiresAt = time.Now().Add(LeaseDuration())
+	return nil
+}
+
+// ReclaimExpiredTasks returns tasks whose lease expired before now to the ready set
+func (s *Store) ReclaimExpiredTasks(now time.Time) []*Task {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+
+	var reclaimed []*Task
+	changed := make(map[string]bool)
+	for id, task := range s.inFlight {
+		if task.Completed || task.Cancelled {
+			delete(s.inFlight, id)
+			continue
+		}
+		if now.After(task.LeaseExpiresAt) {
+			delete(s.inFlight, task.ID)
+			task.InProgress = false
+			task.LeaseExpiresAt = time.Time{}
+			task.Redispatches++
+			// The dependencies were resolved when the task was handed out
+			s.enqueue(task)
+			reclaimed = append(reclaimed, task)
+			changed[task.ExpressionID] = true
+		}
+	}
+	for exprID := range changed {
+		s.saveTasks(exprID, s.exprTasks[exprID])
+	}
+	return reclaimed
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newLeasedTask(t *testing.T) (*Store, *Task) {
+	t.Helper()
+	s := New()
+	expr := s.NewExpression("1 + 1", nil)
+	task := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "1"}, Operator: "+"}
+	s.RegisterTasks(expr.ID, []*Task{task})
+
+	got, ok := s.GetReadyTask("")
+	if !ok || got != task {
+		t.Fatalf("задача не выдана")
+	}
+	return s, task
+}
+
+func TestGetReadyTaskSetsLease(t *testing.T) {
+	_, task := newLeasedTask(t)
+
+	if !task.InProgress || task.LeaseExpiresAt.Before(time.Now()) {
+		t.Errorf("ожидалась действующая аренда, получено %v", task.LeaseExpiresAt)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	s, task := newLeasedTask(t)
+	task.LeaseExpiresAt = time.Now()
+
+	if err := s.RenewLease(task.ID, 0); err != nil {
+		t.Fatalf("ошибка продления аренды: %v", err)
+	}
+	if !task.LeaseExpiresAt.After(time.Now()) {
+		t.Errorf("аренда не продлена")
+	}
+	if err := s.RenewLease(task.ID, 1); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("ожидалась ErrLeaseLost, получено %v", err)
+	}
+	if err := s.RenewLease("task-unknown", 0); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("ожидалась ErrTaskNotFound, получено %v", err)
+	}
+}
+
+func TestReclaimExpiredTasks(t *testing.T) {
+	s, task := newLeasedTask(t)
+
+	if reclaimed := s.ReclaimExpiredTasks(time.Now()); len(reclaimed) != 0 {
+		t.Fatalf("аренда ещё не истекла, возвращено %d задач", len(reclaimed))
+	}
+
+	reclaimed := s.ReclaimExpiredTasks(task.LeaseExpiresAt.Add(time.Millisecond))
+	if len(reclaimed) != 1 || reclaimed[0] != task {
+		t.Fatalf("ожидалась одна возвращённая задача, получено %d", len(reclaimed))
+	}
+	if task.InProgress || !task.Ready || task.Redispatches != 1 {
+		t.Errorf("задача не возвращена в очередь: %+v", task)
+	}
+	// Прежний держатель аренды больше не может её продлить
+	if err := s.RenewLease(task.ID, 0); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("ожидалась ErrLeaseLost, получено %v", err)
+	}
+}
+
+func TestCompleteTaskTwice(t *testing.T) {
+	s, task := newLeasedTask(t)
+
+	if err := s.CompleteTask(task.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Результат агента, потерявшего аренду, не перезаписывает первый
+	if err := s.CompleteTask(task.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ := s.GetExpression(task.ExpressionID)
+	if res.Status != "done" || res.Result != 2 {
+		t.Errorf("ожидался результат 2, получено %s %v", res.Status, res.Result)
+	}
+}
+
+func TestInFlightTracksLeasedTasks(t *testing.T) {
+	s, task := newLeasedTask(t)
+	if len(s.inFlight) != 1 {
+		t.Fatalf("ожидалась одна выданная задача, получено %d", len(s.inFlight))
+	}
+
+	if err := s.CompleteTask(task.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.inFlight) != 0 {
+		t.Errorf("выполненная задача осталась среди выданных")
+	}
+	if reclaimed := s.ReclaimExpiredTasks(time.Now().Add(time.Hour)); len(reclaimed) != 0 {
+		t.Errorf("выполненная задача возвращена в очередь")
+	}
+
+	s, _ = newLeasedTask(t)
+	if err := s.FailTask("task-1", "division by zero"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.inFlight) != 0 {
+		t.Errorf("отменённая задача осталась среди выданных")
+	}
+}
+
+func TestLateResultAfterReclaim(t *testing.T) {
+	s, task := newLeasedTask(t)
+
+	// Аренда истекла, задача снова в очереди, но прежний держатель всё же прислал результат
+	if reclaimed := s.ReclaimExpiredTasks(time.Now().Add(time.Hour)); len(reclaimed) != 1 {
+		t.Fatalf("ожидалась одна возвращённая задача, получено %d", len(reclaimed))
+	}
+	if err := s.CompleteTask(task.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := s.GetReadyTask(""); ok {
+		t.Fatalf("выполненная задача выдана повторно: %+v", got)
+	}
+	if len(s.inFlight) != 0 {
+		t.Errorf("выполненная задача осталась среди выданных")
+	}
+	if reclaimed := s.ReclaimExpiredTasks(time.Now().Add(2 * time.Hour)); len(reclaimed) != 0 {
+		t.Errorf("выполненная задача снова возвращена в очередь")
+	}
+	if res, _ := s.GetExpression(task.ExpressionID); res.Status != "done" || res.Result != 2 {
+		t.Errorf("ожидался результат 2, получено %s %v", res.Status, res.Result)
+	}
+}
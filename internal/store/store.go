@@ -1,210 +1,483 @@
 package store
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 )
 
-var (
-	exprMutex sync.Mutex
-	taskMutex sync.Mutex
+// Store keeps expressions and their tasks. All methods are safe for concurrent use.
+type Store struct {
+	exprMutex  sync.Mutex
+	taskMutex  sync.Mutex
+	agentMutex sync.Mutex
+	eventMutex sync.Mutex
 
 	// Maps to store expressions and tasks
-	expressions = make(map[string]*Expression)
-	tasks       = make(map[string]*Task)
+	expressions map[string]*Expression
+	tasks       map[string]*Task
 
 	// Map to store tasks by expression ID
-	exprTasks = make(map[string][]*Task)
-)
+	exprTasks map[string][]*Task
+
+	// deadlines holds the pending expressions that have a deadline
+	deadlines map[string]*Expression
+
+	// dependents maps a task ID to the tasks waiting for its result
+	dependents map[string][]*Task
+	// readyQueue holds tasks whose dependencies are all resolved, in FIFO order
+	readyQueue []*Task
+	// readySignal is closed and replaced whenever a task is queued,
+	// waking up everyone waiting in WaitReadyTask
+	readySignal chan struct{}
+	// inFlight holds the tasks handed out to agents and not finished yet,
+	// so lease checks do not scan every task ever created
+	inFlight map[string]*Task
+
+	// agents maps an agent ID to the registered agent
+	agents map[string]*Agent
+
+	// subscribers maps an expression ID to the channels receiving its events
+	subscribers map[string]map[chan Event]struct{}
+
+	backend Backend
+}
+
+// New creates an empty in-memory store
+func New() *Store {
+	return &Store{
+		expressions: make(map[string]*Expression),
+		deadlines:   make(map[string]*Expression),
+		tasks:       make(map[string]*Task),
+		exprTasks:   make(map[string][]*Task),
+		dependents:  make(map[string][]*Task),
+		inFlight:    make(map[string]*Task),
+		readySignal: make(chan struct{}),
+		agents:      make(map[string]*Agent),
+		subscribers: make(map[string]map[chan Event]struct{}),
+		backend:     memoryBackend{},
+	}
+}
 
 // Expression represents a mathematical expression
 type Expression struct {
-	ID         string  `json:"id"`
+	ID          string             `json:"id"`
+	Expression  string             `json:"expression"`
+	Variables   map[string]float64 `json:"variables,omitempty"`
+	Status      string             `json:"status"`
+	Result      float64            `json:"result,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Mode        string             `json:"mode,omitempty"`
+	Folded      []FoldedNode       `json:"folded,omitempty"`
+	Distributed []DistributedNode  `json:"distributed,omitempty"`
+	CreatedAt   time.Time
+	// Deadline is when a pending expression times out; zero means never
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// FoldedNode is a subexpression the orchestrator evaluated locally instead of dispatching it
+type FoldedNode struct {
 	Expression string  `json:"expression"`
-	Status     string  `json:"status"`
-	Result     float64 `json:"result,omitempty"`
-	CreatedAt  time.Time
+	Result     float64 `json:"result"`
+}
+
+// DistributedNode is a subexpression dispatched to agents as a task
+type DistributedNode struct {
+	Expression string `json:"expression"`
+	TaskID     string `json:"task_id"`
 }
 
 // Task represents an atomic calculation operation
 type Task struct {
-	ID            string  `json:"id"`
-	ExpressionID  string  `json:"expression_id"`
-	Arg1          string  `json:"arg1"`
-	Arg2          string  `json:"arg2"`
-	Operator      string  `json:"operation"`
-	OperationTime int     `json:"operation_time"`
-	Result        float64 `json:"result,omitempty"`
+	ID           string `json:"id"`
+	ExpressionID string `json:"expression_id"`
+	// Args are numbers or "task:<id>" references to other tasks. References are
+	// replaced with the results when the task becomes ready.
+	Args          []string `json:"args"`
+	Operator      string   `json:"operation"`
+	OperationTime int      `json:"operation_time"`
+	Result        float64  `json:"result,omitempty"`
 	Ready         bool
 	InProgress    bool
 	Completed     bool
+	// Cancelled tasks belong to a failed expression and are never dispatched
+	Cancelled bool `json:"cancelled,omitempty"`
+	// AgentID is the agent the task was last handed to
+	AgentID string `json:"agent_id,omitempty"`
+	// LeaseExpiresAt is the deadline for the agent holding the task to report
+	// a result or renew the lease; after it the task is handed out again
+	LeaseExpiresAt time.Time `json:"lease_expires_at,omitempty"`
+	// Redispatches counts how many times the task was handed out again after a lost lease.
+	// It also identifies the current lease: heartbeats from earlier holders are rejected.
+	Redispatches int `json:"redispatches"`
+
+	// unresolved is the number of arguments referencing tasks that are not completed yet
+	unresolved int
 }
 
-// NewExpression creates a new expression record
-func NewExpression(exprText string) *Expression {
-	exprMutex.Lock()
-	defer exprMutex.Unlock()
+// NewExpression creates a new expression record with the variable bindings it was submitted with
+func (s *Store) NewExpression(exprText string, variables map[string]float64) *Expression {
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
 
 	id := fmt.Sprintf("expr-%d", time.Now().UnixNano())
 
 	expr := &Expression{
 		ID:         id,
 		Expression: exprText,
+		Variables:  variables,
 		Status:     "pending",
 		CreatedAt:  time.Now(),
 	}
 
-	expressions[id] = expr
+	s.expressions[id] = expr
+	s.saveExpression(expr)
 	return expr
 }
 
-// GetExpression retrieves an expression by ID
-func GetExpression(id string) (*Expression, bool) {
-	exprMutex.Lock()
-	defer exprMutex.Unlock()
+// GetExpression retrieves a snapshot of an expression by ID
+func (s *Store) GetExpression(id string) (*Expression, bool) {
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
 
-	expr, found := expressions[id]
-	return expr, found
+	expr, found := s.expressions[id]
+	if !found {
+		return nil, false
+	}
+	snapshot := *expr
+	return &snapshot, true
 }
 
-// ListExpressions returns all expressions
-func ListExpressions() []*Expression {
-	exprMutex.Lock()
-	defer exprMutex.Unlock()
+// ListExpressions returns snapshots of all expressions
+func (s *Store) ListExpressions() []*Expression {
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
 
-	result := make([]*Expression, 0, len(expressions))
-	for _, expr := range expressions {
-		result = append(result, expr)
+	result := make([]*Expression, 0, len(s.expressions))
+	for _, expr := range s.expressions {
+		snapshot := *expr
+		result = append(result, &snapshot)
 	}
 	return result
 }
 
-// RegisterTasks associates tasks with an expression
-func RegisterTasks(exprID string, tasksList []*Task) {
-	taskMutex.Lock()
-	defer taskMutex.Unlock()
+// SetEvaluationPlan records how an expression was split between the orchestrator and agents
+func (s *Store) SetEvaluationPlan(exprID, mode string, folded []FoldedNode, distributed []DistributedNode) {
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
 
-	exprTasks[exprID] = tasksList
+	if expr, found := s.expressions[exprID]; found {
+		expr.Mode = mode
+		expr.Folded = folded
+		expr.Distributed = distributed
+		s.saveExpression(expr)
+	}
+}
 
-	for _, task := range tasksList {
-		tasks[task.ID] = task
+// CompleteExpression marks an expression that needs no tasks as done
+func (s *Store) CompleteExpression(exprID string, result float64) {
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
+
+	// The expression may have been cancelled or timed out before it was evaluated
+	if expr, found := s.expressions[exprID]; found && expr.Status == "pending" {
+		expr.Status = "done"
+		expr.Result = result
+		s.saveExpression(expr)
+		s.publishFinished(expr)
 	}
 }
 
-// UpdateTasksReadiness updates the ready status of tasks
-func UpdateTasksReadiness(exprID string) {
-	taskMutex.Lock()
-	defer taskMutex.Unlock()
+// RegisterTasks associates tasks with an expression and queues the ones
+// that do not depend on other tasks. The expression is listed before its
+// tasks are registered, so it may already be cancelled or timed out; its
+// tasks are then cancelled instead of queued.
+func (s *Store) RegisterTasks(exprID string, tasksList []*Task) {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
 
-	taskList, ok := exprTasks[exprID]
-	if !ok {
+	s.exprTasks[exprID] = tasksList
+
+	for _, task := range tasksList {
+		s.tasks[task.ID] = task
+	}
+
+	s.exprMutex.Lock()
+	expr, found := s.expressions[exprID]
+	pending := found && expr.Status == "pending"
+	s.exprMutex.Unlock()
+
+	if !pending {
+		s.cancelTasks(exprID)
 		return
 	}
+	s.linkTasks(tasksList)
+	s.saveTasks(exprID, tasksList)
+}
 
+// linkTasks counts the unresolved dependencies of each pending task, registers
+// it as a dependent of those tasks and queues it if nothing is left to wait for
+func (s *Store) linkTasks(taskList []*Task) {
 	for _, task := range taskList {
-		if !task.Completed && !task.InProgress {
-			// Check if dependencies are resolved
-			arg1Ready := !isTaskReference(task.Arg1) || isTaskCompleted(task.Arg1[5:])
-			arg2Ready := !isTaskReference(task.Arg2) || isTaskCompleted(task.Arg2[5:])
+		if task.Completed || task.InProgress || task.Cancelled {
+			continue
+		}
+		task.unresolved = 0
+		for _, arg := range task.Args {
+			if isTaskReference(arg) && !s.isTaskCompleted(arg[5:]) {
+				task.unresolved++
+				s.dependents[arg[5:]] = append(s.dependents[arg[5:]], task)
+			}
+		}
+		if task.unresolved == 0 {
+			s.enqueue(task)
+		}
+	}
+}
 
-			task.Ready = arg1Ready && arg2Ready
+// enqueue marks a task as ready and appends it to the ready queue
+func (s *Store) enqueue(task *Task) {
+	if task.Ready {
+		return
+	}
+	s.resolveArgs(task)
+	task.Ready = true
+	s.readyQueue = append(s.readyQueue, task)
+	close(s.readySignal)
+	s.readySignal = make(chan struct{})
+}
+
+// GetReadyTask hands a task that is ready to be processed to the agent agentID.
+// An empty agentID stands for an agent that did not register.
+func (s *Store) GetReadyTask(agentID string) (*Task, bool) {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+
+	return s.dequeue(agentID)
+}
+
+// GetReadyTasks hands up to limit ready tasks to the agent agentID at once
+func (s *Store) GetReadyTasks(agentID string, limit int) []*Task {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+
+	return s.dequeueBatch(agentID, limit)
+}
+
+// WaitReadyTask is like GetReadyTask but, if no task is ready, blocks until
+// one is queued or ctx is done
+func (s *Store) WaitReadyTask(ctx context.Context, agentID string) (*Task, bool) {
+	tasks := s.WaitReadyTasks(ctx, agentID, 1)
+	if len(tasks) == 0 {
+		return nil, false
+	}
+	return tasks[0], true
+}
+
+// WaitReadyTasks is like GetReadyTasks but, if no task is ready, blocks until
+// at least one is queued or ctx is done
+func (s *Store) WaitReadyTasks(ctx context.Context, agentID string, limit int) []*Task {
+	for {
+		s.taskMutex.Lock()
+		tasks := s.dequeueBatch(agentID, limit)
+		signal := s.readySignal
+		s.taskMutex.Unlock()
+		if len(tasks) > 0 {
+			return tasks
+		}
+
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
-// GetReadyTask returns a task that is ready to be processed
-func GetReadyTask() (*Task, bool) {
-	taskMutex.Lock()
-	defer taskMutex.Unlock()
+func (s *Store) dequeueBatch(agentID string, limit int) []*Task {
+	var tasks []*Task
+	for len(tasks) < limit {
+		task, found := s.dequeue(agentID)
+		if !found {
+			break
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// dequeue hands out the next queued task and starts its lease
+func (s *Store) dequeue(agentID string) (*Task, bool) {
+	for len(s.readyQueue) > 0 {
+		task := s.readyQueue[0]
+		s.readyQueue[0] = nil
+		s.readyQueue = s.readyQueue[1:]
 
-	for _, task := range tasks {
-		if task.Ready && !task.InProgress && !task.Completed {
-			task.InProgress = true
+		// Tasks cancelled while queued lose the Ready flag and are skipped here.
+		// A reclaimed task may also be completed by its previous holder while queued.
+		if !task.Ready || task.Completed || task.Cancelled {
 			task.Ready = false
-			return task, true
+			continue
 		}
+		// Tasks of an expression that is finished or past its deadline are
+		// not handed out, even before the periodic ExpireExpressions notices it
+		if s.overdue(task, time.Now()) {
+			continue
+		}
+		task.InProgress = true
+		s.inFlight[task.ID] = task
+		task.Ready = false
+		task.AgentID = agentID
+		task.LeaseExpiresAt = time.Now().Add(LeaseDuration())
+		s.publish(task.ExpressionID, Event{
+			Type:      EventDispatched,
+			TaskID:    task.ID,
+			Operation: task.Operator,
+			AgentID:   agentID,
+		})
+		return task, true
 	}
 
 	return nil, false
 }
 
 // GetTask retrieves a task by ID
-func GetTask(taskID string) (*Task, bool) {
-	taskMutex.Lock()
-	defer taskMutex.Unlock()
+func (s *Store) GetTask(taskID string) (*Task, bool) {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
 
-	task, exists := tasks[taskID]
+	task, exists := s.tasks[taskID]
 	return task, exists
 }
 
 // CompleteTask marks a task as completed and updates dependent tasks
-func CompleteTask(taskID string, result float64) error {
-	taskMutex.Lock()
-	defer taskMutex.Unlock()
+func (s *Store) CompleteTask(taskID string, result float64) error {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
 
 	// Find the task
-	task, exists := tasks[taskID]
+	task, exists := s.tasks[taskID]
 	if !exists {
-		return fmt.Errorf("task not found: %s", taskID)
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
 	}
 
-	// Update task status
+	// A task whose lease expired may be reported twice; the first result wins.
+	// Results of cancelled tasks are dropped.
+	if task.Completed || task.Cancelled {
+		delete(s.inFlight, taskID)
+		return nil
+	}
+
+	// Update task status. A task reclaimed after its lease expired may still be
+	// queued; dropping the Ready flag keeps it from being handed out again.
 	task.Completed = true
+	task.Ready = false
 	task.InProgress = false
+	task.LeaseExpiresAt = time.Time{}
 	task.Result = result
+	delete(s.inFlight, taskID)
+	s.publish(task.ExpressionID, Event{Type: EventCompleted, TaskID: taskID, Operation: task.Operator, Result: &result})
+
+	// Release the tasks waiting for this result
+	for _, dependent := range s.dependents[taskID] {
+		dependent.unresolved--
+		if dependent.unresolved == 0 && !dependent.Cancelled {
+			s.enqueue(dependent)
+		}
+	}
+	delete(s.dependents, taskID)
 
 	// Get expression ID and tasks
 	exprID := task.ExpressionID
-	taskList, ok := exprTasks[exprID]
+	taskList, ok := s.exprTasks[exprID]
 	if !ok {
 		return fmt.Errorf("expression tasks not found: %s", exprID)
 	}
+	s.saveTasks(exprID, taskList)
 
 	// Check if all tasks are completed
 	allCompleted := true
-	var lastTask *Task
-
 	for _, t := range taskList {
 		if !t.Completed {
 			allCompleted = false
 			break
 		}
-		// Identify the last task (root of expression tree)
-		if lastTask == nil || t.ID > lastTask.ID {
-			lastTask = t
-		}
+	}
+
+	// Tasks are registered in post-order, so the root of the expression is the last one
+	var lastTask *Task
+	if len(taskList) > 0 {
+		lastTask = taskList[len(taskList)-1]
 	}
 
 	// Update expression status if all tasks are completed
-	exprMutex.Lock()
-	defer exprMutex.Unlock()
-
-	if expr, found := expressions[exprID]; found {
-		if allCompleted && lastTask != nil {
-			expr.Status = "done"
-			expr.Result = lastTask.Result
-		} else {
-			// Update readiness of dependent tasks
-			for _, t := range taskList {
-				if !t.Completed && !t.InProgress {
-					arg1Ready := !isTaskReference(t.Arg1) || isTaskCompleted(t.Arg1[5:])
-					arg2Ready := !isTaskReference(t.Arg2) || isTaskCompleted(t.Arg2[5:])
-					t.Ready = arg1Ready && arg2Ready
-				}
-			}
-		}
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
+
+	// A result may still arrive for an expression that was cancelled or timed out
+	if expr, found := s.expressions[exprID]; found && expr.Status == "pending" && allCompleted && lastTask != nil {
+		expr.Status = "done"
+		expr.Result = lastTask.Result
+		s.saveExpression(expr)
+		s.publishFinished(expr)
+	}
+
+	return nil
+}
+
+// FailTask marks the expression of a task as failed with reason and cancels
+// its remaining tasks so they are never dispatched
+func (s *Store) FailTask(taskID, reason string) error {
+	s.taskMutex.Lock()
+	defer s.taskMutex.Unlock()
+
+	task, exists := s.tasks[taskID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+	if task.Completed || task.Cancelled {
+		return nil
+	}
+
+	exprID := task.ExpressionID
+	if _, ok := s.exprTasks[exprID]; !ok {
+		return fmt.Errorf("expression tasks not found: %s", exprID)
 	}
+	s.publish(exprID, Event{Type: EventFailed, TaskID: taskID, Operation: task.Operator, Error: reason})
+	s.cancelTasks(exprID)
 
+	s.exprMutex.Lock()
+	defer s.exprMutex.Unlock()
+
+	if expr, found := s.expressions[exprID]; found {
+		expr.Status = "error"
+		expr.Error = reason
+		s.saveExpression(expr)
+		s.publishFinished(expr)
+	}
 	return nil
 }
 
+// resolveArgs replaces references to completed tasks in the arguments with
+// their results, so agents receive concrete numbers and never fetch them
+func (s *Store) resolveArgs(task *Task) {
+	for i, arg := range task.Args {
+		if isTaskReference(arg) {
+			if dep, exists := s.tasks[arg[5:]]; exists && dep.Completed {
+				task.Args[i] = strconv.FormatFloat(dep.Result, 'g', -1, 64)
+			}
+		}
+	}
+}
+
 // Helper functions
 func isTaskReference(arg string) bool {
 	return len(arg) > 5 && arg[:5] == "task:"
 }
 
-func isTaskCompleted(taskID string) bool {
-	task, exists := tasks[taskID]
+func (s *Store) isTaskCompleted(taskID string) bool {
+	task, exists := s.tasks[taskID]
 	return exists && task.Completed
 }
@@ -1,11 +1,15 @@
 package store
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestNewExpression(t *testing.T) {
-	expr := NewExpression("3 + 5")
+	s := New()
+	expr := s.NewExpression("3 + 5", nil)
 
 	if expr.Expression != "3 + 5" {
 		t.Errorf("ожидалось '3 + 5', получено %s", expr.Expression)
@@ -17,8 +21,9 @@ func TestNewExpression(t *testing.T) {
 }
 
 func TestGetExpression(t *testing.T) {
-	expr := NewExpression("2 * 2")
-	res, found := GetExpression(expr.ID)
+	s := New()
+	expr := s.NewExpression("2 * 2", nil)
+	res, found := s.GetExpression(expr.ID)
 
 	if !found {
 		t.Errorf("выражение не найдено")
@@ -30,35 +35,34 @@ func TestGetExpression(t *testing.T) {
 }
 
 func TestRegisterTasksAndGetTask(t *testing.T) {
-	expr := NewExpression("1 + 1")
+	s := New()
+	expr := s.NewExpression("1 + 1", nil)
 	task := &Task{
 		ID:           "task-1",
 		ExpressionID: expr.ID,
-		Arg1:         "1",
-		Arg2:         "1",
+		Args:         []string{"1", "1"},
 		Operator:     "+",
 	}
 
-	RegisterTasks(expr.ID, []*Task{task})
-	res, found := GetTask("task-1")
+	s.RegisterTasks(expr.ID, []*Task{task})
+	res, found := s.GetTask("task-1")
 
 	if !found || res.ID != "task-1" {
 		t.Errorf("задача не зарегистрирована")
 	}
 }
 
-func TestUpdateTasksReadiness(t *testing.T) {
-	expr := NewExpression("1 + 1")
+func TestRegisterTasksMarksReady(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1 + 1", nil)
 	task := &Task{
 		ID:           "task-1",
 		ExpressionID: expr.ID,
-		Arg1:         "1",
-		Arg2:         "1",
+		Args:         []string{"1", "1"},
 		Operator:     "+",
 	}
 
-	RegisterTasks(expr.ID, []*Task{task})
-	UpdateTasksReadiness(expr.ID)
+	s.RegisterTasks(expr.ID, []*Task{task})
 
 	if !task.Ready {
 		t.Errorf("задача должна быть готова")
@@ -66,17 +70,17 @@ func TestUpdateTasksReadiness(t *testing.T) {
 }
 
 func TestCompleteTask(t *testing.T) {
-	expr := NewExpression("3 + 2")
+	s := New()
+	expr := s.NewExpression("3 + 2", nil)
 	task := &Task{
 		ID:           "task-1",
 		ExpressionID: expr.ID,
-		Arg1:         "3",
-		Arg2:         "2",
+		Args:         []string{"3", "2"},
 		Operator:     "+",
 	}
 
-	RegisterTasks(expr.ID, []*Task{task})
-	err := CompleteTask("task-1", 5)
+	s.RegisterTasks(expr.ID, []*Task{task})
+	err := s.CompleteTask("task-1", 5)
 
 	if err != nil {
 		t.Errorf("ошибка завершения задачи: %v", err)
@@ -86,3 +90,150 @@ func TestCompleteTask(t *testing.T) {
 		t.Errorf("задача не завершена корректно")
 	}
 }
+
+func TestCompleteTaskUsesRootResult(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("(1+1)*5", nil)
+	// ID корня лексикографически меньше ID его аргумента
+	first := &Task{ID: "task-root-9", ExpressionID: expr.ID, Args: []string{"1", "1"}, Operator: "+"}
+	root := &Task{ID: "task-root-10", ExpressionID: expr.ID, Args: []string{"task:task-root-9", "5"}, Operator: "*"}
+
+	s.RegisterTasks(expr.ID, []*Task{first, root})
+	if err := s.CompleteTask(first.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Ready {
+		t.Errorf("задача должна стать готовой после завершения зависимости")
+	}
+	if err := s.CompleteTask(root.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ := s.GetExpression(expr.ID)
+	if res.Status != "done" || res.Result != 10 {
+		t.Errorf("ожидался результат 10, получено %s %v", res.Status, res.Result)
+	}
+}
+
+func TestFailTaskCancelsSiblings(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1/0+2*3", nil)
+	div := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "0"}, Operator: "/"}
+	mul := &Task{ID: "task-2", ExpressionID: expr.ID, Args: []string{"2", "3"}, Operator: "*"}
+	sum := &Task{ID: "task-3", ExpressionID: expr.ID, Args: []string{"task:task-1", "task:task-2"}, Operator: "+"}
+
+	s.RegisterTasks(expr.ID, []*Task{div, mul, sum})
+	if _, ok := s.GetReadyTask(""); !ok {
+		t.Fatal("задача не выдана")
+	}
+
+	if err := s.FailTask(div.ID, "division by zero"); err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ := s.GetExpression(expr.ID)
+	if res.Status != "error" || res.Error != "division by zero" {
+		t.Errorf("ожидался статус error, получено %s %q", res.Status, res.Error)
+	}
+	for _, task := range []*Task{div, mul, sum} {
+		if !task.Cancelled || task.Ready || task.InProgress {
+			t.Errorf("задача %s не отменена: %+v", task.ID, task)
+		}
+	}
+	if task, ok := s.GetReadyTask(""); ok {
+		t.Errorf("отменённая задача %s выдана агенту", task.ID)
+	}
+	// Результат отменённой задачи не меняет статус выражения
+	if err := s.CompleteTask(mul.ID, 6); err != nil || mul.Completed {
+		t.Errorf("результат отменённой задачи принят")
+	}
+	if res, _ := s.GetExpression(expr.ID); res.Status != "error" {
+		t.Errorf("ожидался статус error, получено %s", res.Status)
+	}
+}
+
+func TestReadyQueueFollowsDependencies(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("(1+2)*(1+2)+3*4", nil)
+	sum := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "2"}, Operator: "+"}
+	// Общее подвыражение: оба аргумента ссылаются на одну задачу
+	square := &Task{ID: "task-2", ExpressionID: expr.ID, Args: []string{"task:task-1", "task:task-1"}, Operator: "*"}
+	mul := &Task{ID: "task-3", ExpressionID: expr.ID, Args: []string{"3", "4"}, Operator: "*"}
+	root := &Task{ID: "task-4", ExpressionID: expr.ID, Args: []string{"task:task-2", "task:task-3"}, Operator: "+"}
+	s.RegisterTasks(expr.ID, []*Task{sum, square, mul, root})
+
+	next := func() *Task {
+		task, ok := s.GetReadyTask("")
+		if !ok {
+			t.Fatal("нет готовой задачи")
+		}
+		return task
+	}
+
+	if first, second := next(), next(); first != sum || second != mul {
+		t.Fatalf("ожидались независимые задачи task-1 и task-3, получено %s и %s", first.ID, second.ID)
+	}
+	if task, ok := s.GetReadyTask(""); ok {
+		t.Fatalf("задача %s выдана до разрешения зависимостей", task.ID)
+	}
+
+	s.CompleteTask(mul.ID, 12)
+	s.CompleteTask(sum.ID, 3)
+	if task := next(); task != square {
+		t.Fatalf("ожидалась task-2, получено %s", task.ID)
+	}
+	// Ссылки на выполненные задачи заменены их результатами
+	if square.Args[0] != "3" || square.Args[1] != "3" {
+		t.Errorf("ожидались аргументы [3 3], получено %v", square.Args)
+	}
+	s.CompleteTask(square.ID, 9)
+	if task := next(); task != root {
+		t.Fatalf("ожидалась task-4, получено %s", task.ID)
+	}
+	s.CompleteTask(root.ID, 21)
+
+	if res, _ := s.GetExpression(expr.ID); res.Status != "done" || res.Result != 21 {
+		t.Errorf("ожидался результат 21, получено %s %v", res.Status, res.Result)
+	}
+}
+
+func TestWaitReadyTask(t *testing.T) {
+	s := New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, ok := s.WaitReadyTask(ctx, ""); ok {
+		t.Fatal("задача выдана из пустой очереди")
+	}
+
+	expr := s.NewExpression("1 + 1", nil)
+	task := &Task{ID: "task-1", ExpressionID: expr.ID, Args: []string{"1", "1"}, Operator: "+"}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.RegisterTasks(expr.ID, []*Task{task})
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, ok := s.WaitReadyTask(ctx, "")
+	if !ok || got != task || !task.InProgress {
+		t.Errorf("ожидалась задача task-1 после её регистрации")
+	}
+}
+
+func TestGetReadyTasks(t *testing.T) {
+	s := New()
+	expr := s.NewExpression("1+2+3+4", nil)
+	var taskList []*Task
+	for i := 1; i <= 3; i++ {
+		taskList = append(taskList, &Task{ID: fmt.Sprintf("task-%d", i), ExpressionID: expr.ID, Args: []string{"1", "2"}, Operator: "+"})
+	}
+	s.RegisterTasks(expr.ID, taskList)
+
+	if tasks := s.GetReadyTasks("agent-1", 2); len(tasks) != 2 || tasks[0].AgentID != "agent-1" {
+		t.Fatalf("ожидались 2 задачи агента agent-1, получено %d", len(tasks))
+	}
+	if tasks := s.GetReadyTasks("agent-1", 5); len(tasks) != 1 || tasks[0] != taskList[2] {
+		t.Fatalf("ожидалась оставшаяся задача task-3, получено %d", len(tasks))
+	}
+}